@@ -0,0 +1,67 @@
+package goamf
+
+import (
+  "sync"
+  "reflect"
+)
+
+var classAliases struct {
+  sync.RWMutex
+  types map[string]reflect.Type
+  aliases map[reflect.Type]string
+}
+
+// RegisterClassAlias associates an ActionScript class alias with the Go
+// struct type of goType, the equivalent of registerClassAlias or
+// [RemoteClass] in ActionScript. Typed objects carrying the alias decode
+// into a new value of that type, and values of that type are encoded with
+// the alias as their class name. goType may be a struct or a pointer to
+// one. Types whose pointer implements Externalizable may be of any kind.
+func RegisterClassAlias(alias string, goType interface{}) {
+  t := reflect.TypeOf(goType)
+  for t != nil && t.Kind() == reflect.Ptr {
+    t = t.Elem()
+  }
+  if alias == "" || t == nil {
+    panic("goamf: RegisterClassAlias needs an alias and a type")
+  }
+  if t.Kind() != reflect.Struct && !reflect.PtrTo(t).Implements(externalizableType) {
+    panic("goamf: RegisterClassAlias needs a struct or externalizable type")
+  }
+
+  classAliases.Lock()
+  defer classAliases.Unlock()
+  if classAliases.types == nil {
+    classAliases.types = make(map[string]reflect.Type)
+    classAliases.aliases = make(map[reflect.Type]string)
+  }
+
+  if old, ok := classAliases.types[alias]; ok {
+    delete(classAliases.aliases, old)
+  }
+  if old, ok := classAliases.aliases[t]; ok {
+    delete(classAliases.types, old)
+  }
+  classAliases.types[alias] = t
+  classAliases.aliases[t] = alias
+}
+
+// aliasType returns the Go type registered for alias.
+func aliasType(alias string) (reflect.Type, bool) {
+  if alias == "" {
+    return nil, false
+  }
+
+  classAliases.RLock()
+  defer classAliases.RUnlock()
+  t, ok := classAliases.types[alias]
+  return t, ok
+}
+
+// typeAlias returns the alias registered for the struct type t.
+func typeAlias(t reflect.Type) (string, bool) {
+  classAliases.RLock()
+  defer classAliases.RUnlock()
+  alias, ok := classAliases.aliases[t]
+  return alias, ok
+}
@@ -0,0 +1,50 @@
+package goamf
+
+import (
+  "testing"
+)
+
+type testUserVO struct {
+  Name string `amf:"name"`
+  Friend *testUserVO `amf:"friend"`
+}
+
+func TestClassAlias(t *testing.T) {
+  RegisterClassAlias("com.example.UserVO", testUserVO{})
+
+  u := &testUserVO{Name: "a"}
+  u.Friend = u
+  var out []interface{}
+  roundTrip(t, AMF3, []interface{}{u, u, testUserVO{Name: "b"}}, &out)
+  a, ok := out[0].(*testUserVO)
+  if !ok || a.Friend != a || out[1] != a || out[2].(*testUserVO).Name != "b" {
+    t.Fatalf("Got %#v", out)
+  }
+
+  data := mustMarshal(t, AMF0, testUserVO{Name: "c"})
+  var v interface{}
+  if err := Unmarshal(data, &v); err != nil {
+    t.Fatal(err)
+  }
+  if vo, ok := v.(*testUserVO); !ok || vo.Name != "c" {
+    t.Fatalf("Got %#v", v)
+  }
+
+  var vo testUserVO
+  if err := Unmarshal(data, &vo); err != nil || vo.Name != "c" {
+    t.Fatalf("Got %#v, %v", vo, err)
+  }
+}
+
+func TestRegisterClassAliasPanics(t *testing.T) {
+  for _, v := range []interface{}{nil, 1, "x"} {
+    func() {
+      defer func() {
+        if recover() == nil {
+          t.Fatalf("%#v was registered", v)
+        }
+      }()
+      RegisterClassAlias("com.example.Bad", v)
+    }()
+  }
+}
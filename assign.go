@@ -0,0 +1,384 @@
+package goamf
+
+import (
+  "math"
+  "time"
+  "strconv"
+  "reflect"
+)
+
+// An UnmarshalTypeError describes an AMF value that was not appropriate
+// for a value of a specific Go type.
+type UnmarshalTypeError struct {
+  Value string
+  Type reflect.Type
+  Path string
+}
+
+func (e *UnmarshalTypeError) Error() string {
+  if e.Path == "" {
+    return "Can not unmarshal AMF " + e.Value + " into Go value of type " + e.Type.String()
+  }
+  return "Can not unmarshal AMF " + e.Value + " into Go value " + e.Path + " of type " + e.Type.String()
+}
+
+// An InvalidUnmarshalError describes an invalid argument passed to Decode.
+type InvalidUnmarshalError struct {
+  Type reflect.Type
+}
+
+func (e *InvalidUnmarshalError) Error() string {
+  if e.Type == nil {
+    return "Unmarshal target must be a non-nil pointer, got nil"
+  }
+  return "Unmarshal target must be a non-nil pointer, got " + e.Type.String()
+}
+
+func describeValue(src interface{}) string {
+  switch src.(type) {
+  case nil:
+    return "null"
+  case Undefined:
+    return "undefined"
+  case bool:
+    return "boolean"
+  case float64, int32:
+    return "number"
+  case string:
+    return "string"
+  case []interface{}:
+    return "strict array"
+  case *AMF3Array:
+    return "array"
+  case *AMF0Object, *AMF0TypedObject, *AMF3Object:
+    return "object"
+  case *AMF0ECMAArray:
+    return "ECMA array"
+  case time.Time:
+    return "date"
+  case *ByteArray:
+    return "ByteArray"
+  case XML, XMLDocument:
+    return "XML"
+  case *Vector:
+    return "Vector"
+  case *Dictionary:
+    return "Dictionary"
+  }
+  return reflect.TypeOf(src).String()
+}
+
+func indexPath(path string, i int) string {
+  return path + "[" + strconv.Itoa(i) + "]"
+}
+
+func memberPath(path, name string) string {
+  if path == "" {
+    return name
+  }
+  return path + "." + name
+}
+
+// assignKey identifies a decoded object, array or map by its address and
+// length, together with the Go type it is converted to.
+type assignKey struct {
+  src uintptr
+  n int
+  t reflect.Type
+}
+
+// assignState converts a decoded value graph into Go values. Shared and
+// cyclic objects are converted once per target pointer, map or slice
+// type, so referenced objects stay shared and cycles terminate.
+type assignState struct {
+  seen map[assignKey]reflect.Value
+  version uint16
+}
+
+func assignValue(dst reflect.Value, src interface{}, version uint16) error {
+  return (&assignState{version: version}).assign(dst, src, "")
+}
+
+// assign stores the decoded AMF value src into dst, converting between the
+// generic decoder types and the Go type of dst.
+func (a *assignState) assign(dst reflect.Value, src interface{}, path string) error {
+  if dst.Kind() != reflect.Ptr && dst.CanAddr() && dst.Addr().Type().Implements(unmarshalerType) {
+    dec := &Decoder{replay: &replayValue{a, src, path}}
+    return dst.Addr().Interface().(Unmarshaler).UnmarshalAMF(dec)
+  }
+
+  if _, ok := src.(Undefined); ok || src == nil {
+    switch dst.Kind() {
+    case reflect.Interface, reflect.Ptr, reflect.Map, reflect.Slice:
+      dst.Set(reflect.Zero(dst.Type()))
+    }
+    return nil
+  }
+
+  sv := reflect.ValueOf(src)
+  if sv.Type().AssignableTo(dst.Type()) {
+    dst.Set(sv)
+    return nil
+  }
+
+  if sv.Kind() == reflect.Ptr && !sv.IsNil() && sv.Elem().Type().AssignableTo(dst.Type()) {
+    dst.Set(sv.Elem())
+    return nil
+  }
+
+  if small, ok := src.(smallMessage); ok {
+    return a.assign(dst, small.fullMessage(), path)
+  }
+
+  var key *assignKey
+  switch dst.Kind() {
+  case reflect.Ptr, reflect.Map, reflect.Slice:
+    key = sharedKey(sv, dst.Type())
+    if key != nil {
+      if v, ok := a.seen[*key]; ok {
+        dst.Set(v)
+        return nil
+      }
+    }
+  }
+
+  switch dst.Kind() {
+  case reflect.Ptr:
+    if dst.IsNil() {
+      dst.Set(reflect.New(dst.Type().Elem()))
+    }
+    a.remember(key, dst.Elem().Addr())
+    return a.assign(dst.Elem(), src, path)
+  case reflect.Bool:
+    if b, ok := src.(bool); ok {
+      dst.SetBool(b)
+      return nil
+    }
+  case reflect.String:
+    if sv.Kind() == reflect.String {
+      dst.SetString(sv.String())
+      return nil
+    }
+  case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+    if f, ok := numberValue(src); ok && f == math.Trunc(f) && f >= math.MinInt64 && f < math.MaxInt64 {
+      if !dst.OverflowInt(int64(f)) {
+        dst.SetInt(int64(f))
+        return nil
+      }
+    }
+  case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+    if f, ok := numberValue(src); ok && f == math.Trunc(f) && f >= 0 && f < math.MaxUint64 {
+      if !dst.OverflowUint(uint64(f)) {
+        dst.SetUint(uint64(f))
+        return nil
+      }
+    }
+  case reflect.Float32, reflect.Float64:
+    if f, ok := numberValue(src); ok && !dst.OverflowFloat(f) {
+      dst.SetFloat(f)
+      return nil
+    }
+  case reflect.Slice, reflect.Array:
+    if ba, ok := src.(*ByteArray); ok && dst.Kind() == reflect.Slice && dst.Type().Elem().Kind() == reflect.Uint8 {
+      dst.SetBytes(append([]byte(nil), ba.Bytes()...))
+      return nil
+    }
+    if values, ok := arrayValues(src); ok {
+      return a.assignArray(dst, values, key, path)
+    }
+  case reflect.Map:
+    if dict, ok := src.(*Dictionary); ok {
+      return a.assignDictionary(dst, dict, key, path)
+    }
+    if values, ok := objectValues(src); ok && dst.Type().Key().Kind() == reflect.String {
+      return a.assignMap(dst, values, key, path)
+    }
+  case reflect.Struct:
+    if values, ok := objectValues(src); ok {
+      return a.assignStruct(dst, values, path)
+    }
+  }
+
+  return &UnmarshalTypeError{describeValue(src), dst.Type(), path}
+}
+
+// sharedKey returns the key of the decoded value sv for the Go type t, or
+// nil when sv is not a reference that could be shared.
+func sharedKey(sv reflect.Value, t reflect.Type) *assignKey {
+  switch sv.Kind() {
+  case reflect.Ptr, reflect.Map:
+    if !sv.IsNil() {
+      return &assignKey{sv.Pointer(), 0, t}
+    }
+  case reflect.Slice:
+    if sv.Len() > 0 {
+      return &assignKey{sv.Pointer(), sv.Len(), t}
+    }
+  }
+  return nil
+}
+
+// remember records v as the conversion of the value of key, before its
+// content is converted, so that cycles back to it find v.
+func (a *assignState) remember(key *assignKey, v reflect.Value) {
+  if key == nil {
+    return
+  }
+
+  if a.seen == nil {
+    a.seen = make(map[assignKey]reflect.Value)
+  }
+  a.seen[*key] = v
+}
+
+func numberValue(src interface{}) (float64, bool) {
+  switch n := src.(type) {
+  case float64:
+    return n, true
+  case int32:
+    return float64(n), true
+  case uint32:
+    return float64(n), true
+  }
+  return 0, false
+}
+
+func arrayValues(src interface{}) ([]interface{}, bool) {
+  switch arr := src.(type) {
+  case []interface{}:
+    return arr, true
+  case *AMF3Array:
+    return arr.DenseValues, true
+  case *ArrayCollection:
+    return *arr, true
+  case *ArrayList:
+    return *arr, true
+  case *Vector:
+    if values, ok := arr.Values.([]interface{}); ok {
+      return values, true
+    }
+
+    rv := reflect.ValueOf(arr.Values)
+    if rv.Kind() != reflect.Slice {
+      return nil, false
+    }
+    values := make([]interface{}, rv.Len())
+    for i := range values {
+      values[i] = rv.Index(i).Interface()
+    }
+    return values, true
+  }
+  return nil, false
+}
+
+func objectValues(src interface{}) (map[string]interface{}, bool) {
+  switch obj := src.(type) {
+  case *AMF0Object:
+    return obj.Values, true
+  case *AMF0TypedObject:
+    return obj.values, true
+  case *AMF0ECMAArray:
+    return obj.Values, true
+  case *ObjectProxy:
+    return *obj, true
+  case *AMF3Array:
+    return obj.AssocValues, len(obj.DenseValues) == 0
+  case *AMF3Object:
+    if len(obj.DynValues) == 0 {
+      return obj.Values, true
+    }
+
+    values := make(map[string]interface{}, len(obj.Values)+len(obj.DynValues))
+    for k, v := range obj.DynValues {
+      values[k] = v
+    }
+    for k, v := range obj.Values {
+      values[k] = v
+    }
+    return values, true
+  }
+  return nil, false
+}
+
+func (a *assignState) assignArray(dst reflect.Value, values []interface{}, key *assignKey, path string) error {
+  length := len(values)
+  if dst.Kind() == reflect.Slice {
+    dst.Set(reflect.MakeSlice(dst.Type(), length, length))
+    a.remember(key, dst)
+  } else if length > dst.Len() {
+    length = dst.Len()
+  }
+
+  for i := 0; i < length; i++ {
+    err := a.assign(dst.Index(i), values[i], indexPath(path, i))
+    if err != nil {
+      return err
+    }
+  }
+
+  if dst.Kind() == reflect.Array {
+    zero := reflect.Zero(dst.Type().Elem())
+    for i := length; i < dst.Len(); i++ {
+      dst.Index(i).Set(zero)
+    }
+  }
+  return nil
+}
+
+func (a *assignState) assignMap(dst reflect.Value, values map[string]interface{}, key *assignKey, path string) error {
+  t := dst.Type()
+  if dst.IsNil() {
+    dst.Set(reflect.MakeMap(t))
+  }
+  a.remember(key, dst)
+
+  for k, v := range values {
+    elem := reflect.New(t.Elem()).Elem()
+    err := a.assign(elem, v, memberPath(path, k))
+    if err != nil {
+      return err
+    }
+    dst.SetMapIndex(reflect.ValueOf(k).Convert(t.Key()), elem)
+  }
+  return nil
+}
+
+func (a *assignState) assignDictionary(dst reflect.Value, dict *Dictionary, key *assignKey, path string) error {
+  t := dst.Type()
+  if dst.IsNil() {
+    dst.Set(reflect.MakeMap(t))
+  }
+  a.remember(key, dst)
+
+  for i, entry := range dict.Entries {
+    k := reflect.New(t.Key()).Elem()
+    err := a.assign(k, entry.Key, indexPath(path, i) + ".key")
+    if err != nil {
+      return err
+    }
+
+    elem := reflect.New(t.Elem()).Elem()
+    err = a.assign(elem, entry.Value, indexPath(path, i) + ".value")
+    if err != nil {
+      return err
+    }
+    dst.SetMapIndex(k, elem)
+  }
+  return nil
+}
+
+func (a *assignState) assignStruct(dst reflect.Value, values map[string]interface{}, path string) error {
+  fields := cachedTypeFields(dst.Type())
+  for k, v := range values {
+    f := findField(fields, k)
+    if f == nil {
+      continue
+    }
+
+    err := a.assign(fieldByIndex(dst, f.index), v, memberPath(path, f.name))
+    if err != nil {
+      return err
+    }
+  }
+  return nil
+}
@@ -0,0 +1,355 @@
+package goamf
+
+import (
+  "io"
+  "bytes"
+  "errors"
+  "io/ioutil"
+  "compress/zlib"
+  "compress/flate"
+  "encoding/binary"
+)
+
+const (
+  CompressionZlib = "zlib"
+  CompressionDeflate = "deflate"
+)
+
+// DataInput is the ActionScript IDataInput interface.
+type DataInput interface {
+  io.Reader
+  io.ByteReader
+  ReadBoolean() (bool, error)
+  ReadSignedByte() (int8, error)
+  ReadUnsignedByte() (uint8, error)
+  ReadShort() (int16, error)
+  ReadUnsignedShort() (uint16, error)
+  ReadInt() (int32, error)
+  ReadUnsignedInt() (uint32, error)
+  ReadFloat() (float32, error)
+  ReadDouble() (float64, error)
+  ReadUTF() (string, error)
+  ReadUTFBytes(length int) (string, error)
+  ReadBytes(length int) ([]byte, error)
+  ReadObject() (interface{}, error)
+}
+
+// DataOutput is the ActionScript IDataOutput interface.
+type DataOutput interface {
+  io.Writer
+  io.ByteWriter
+  WriteBoolean(b bool) error
+  WriteShort(n int16) error
+  WriteInt(n int32) error
+  WriteUnsignedInt(n uint32) error
+  WriteFloat(f float32) error
+  WriteDouble(f float64) error
+  WriteUTF(str string) error
+  WriteUTFBytes(str string) error
+  WriteBytes(data []byte) error
+  WriteObject(v interface{}) error
+}
+
+// ByteArray is the AMF3 ByteArray. Like the ActionScript class it has a
+// position shared by reads and writes, a byte order for multi-byte values
+// and an object encoding used by ReadObject and WriteObject.
+type ByteArray struct {
+  Endian binary.ByteOrder
+  ObjectEncoding uint16
+  buf []byte
+  pos int
+}
+
+// NewByteArray returns a big-endian ByteArray holding data, positioned at
+// its start.
+func NewByteArray(data []byte) *ByteArray {
+  return &ByteArray{binary.BigEndian, AMF3, data, 0}
+}
+
+func (ba *ByteArray) order() binary.ByteOrder {
+  if ba.Endian == nil {
+    return binary.BigEndian
+  }
+  return ba.Endian
+}
+
+// Bytes returns the whole content regardless of the position.
+func (ba *ByteArray) Bytes() []byte {
+  return ba.buf
+}
+
+func (ba *ByteArray) Len() int {
+  return len(ba.buf)
+}
+
+func (ba *ByteArray) Position() int {
+  return ba.pos
+}
+
+func (ba *ByteArray) SetPosition(pos int) {
+  if pos < 0 {
+    pos = 0
+  }
+  ba.pos = pos
+}
+
+func (ba *ByteArray) BytesAvailable() int {
+  if ba.pos >= len(ba.buf) {
+    return 0
+  }
+  return len(ba.buf) - ba.pos
+}
+
+func (ba *ByteArray) Clear() {
+  ba.buf = nil
+  ba.pos = 0
+}
+
+func (ba *ByteArray) Read(p []byte) (int, error) {
+  if len(p) == 0 {
+    return 0, nil
+  }
+
+  if ba.BytesAvailable() == 0 {
+    return 0, io.EOF
+  }
+
+  n := copy(p, ba.buf[ba.pos:])
+  ba.pos += n
+  return n, nil
+}
+
+func (ba *ByteArray) ReadByte() (byte, error) {
+  if ba.BytesAvailable() == 0 {
+    return 0, io.EOF
+  }
+
+  b := ba.buf[ba.pos]
+  ba.pos++
+  return b, nil
+}
+
+// Write writes p at the position, overwriting existing bytes and growing
+// the array as needed.
+func (ba *ByteArray) Write(p []byte) (int, error) {
+  end := ba.pos + len(p)
+  if end > len(ba.buf) {
+    if end > cap(ba.buf) {
+      buf := make([]byte, end, end * 2)
+      copy(buf, ba.buf)
+      ba.buf = buf
+    }
+    ba.buf = ba.buf[:end]
+  }
+
+  copy(ba.buf[ba.pos:], p)
+  ba.pos = end
+  return len(p), nil
+}
+
+func (ba *ByteArray) WriteByte(c byte) error {
+  _, err := ba.Write([]byte{c})
+  return err
+}
+
+func (ba *ByteArray) read(v interface{}) error {
+  err := binary.Read(ba, ba.order(), v)
+  if err == io.ErrUnexpectedEOF {
+    return io.EOF
+  }
+  return err
+}
+
+func (ba *ByteArray) write(v interface{}) error {
+  return binary.Write(ba, ba.order(), v)
+}
+
+func (ba *ByteArray) ReadBoolean() (bool, error) {
+  b, err := ba.ReadByte()
+  return b != 0x00, err
+}
+
+func (ba *ByteArray) ReadSignedByte() (int8, error) {
+  b, err := ba.ReadByte()
+  return int8(b), err
+}
+
+func (ba *ByteArray) ReadUnsignedByte() (uint8, error) {
+  return ba.ReadByte()
+}
+
+func (ba *ByteArray) ReadShort() (n int16, err error) {
+  err = ba.read(&n)
+  return
+}
+
+func (ba *ByteArray) ReadUnsignedShort() (n uint16, err error) {
+  err = ba.read(&n)
+  return
+}
+
+func (ba *ByteArray) ReadInt() (n int32, err error) {
+  err = ba.read(&n)
+  return
+}
+
+func (ba *ByteArray) ReadUnsignedInt() (n uint32, err error) {
+  err = ba.read(&n)
+  return
+}
+
+func (ba *ByteArray) ReadFloat() (f float32, err error) {
+  err = ba.read(&f)
+  return
+}
+
+func (ba *ByteArray) ReadDouble() (f float64, err error) {
+  err = ba.read(&f)
+  return
+}
+
+// ReadUTF reads a string prefixed by its unsigned 16-bit length.
+func (ba *ByteArray) ReadUTF() (string, error) {
+  length, err := ba.ReadUnsignedShort()
+  if err != nil {
+    return "", err
+  }
+  return ba.ReadUTFBytes(int(length))
+}
+
+func (ba *ByteArray) ReadUTFBytes(length int) (string, error) {
+  data, err := ba.ReadBytes(length)
+  return string(data), err
+}
+
+func (ba *ByteArray) ReadBytes(length int) ([]byte, error) {
+  if length < 0 || length > ba.BytesAvailable() {
+    return nil, io.EOF
+  }
+
+  data := make([]byte, length)
+  copy(data, ba.buf[ba.pos:])
+  ba.pos += length
+  return data, nil
+}
+
+// ReadObject decodes a value in the ObjectEncoding version. Every call has
+// its own reference tables.
+func (ba *ByteArray) ReadObject() (interface{}, error) {
+  d := &decodeState{Reader: ba, refStore: newRefStore(), version: ba.ObjectEncoding}
+  return d.unmarshal()
+}
+
+func (ba *ByteArray) WriteBoolean(b bool) error {
+  if b {
+    return ba.WriteByte(0x01)
+  }
+  return ba.WriteByte(0x00)
+}
+
+func (ba *ByteArray) WriteShort(n int16) error {
+  return ba.write(n)
+}
+
+func (ba *ByteArray) WriteInt(n int32) error {
+  return ba.write(n)
+}
+
+func (ba *ByteArray) WriteUnsignedInt(n uint32) error {
+  return ba.write(n)
+}
+
+func (ba *ByteArray) WriteFloat(f float32) error {
+  return ba.write(f)
+}
+
+func (ba *ByteArray) WriteDouble(f float64) error {
+  return ba.write(f)
+}
+
+func (ba *ByteArray) WriteUTF(str string) error {
+  if len(str) > AMF0_MAX_STRING_LEN {
+    return errors.New("The length of UTF string is out of range")
+  }
+
+  err := ba.write(uint16(len(str)))
+  if err != nil {
+    return err
+  }
+  return ba.WriteUTFBytes(str)
+}
+
+func (ba *ByteArray) WriteUTFBytes(str string) error {
+  _, err := ba.Write([]byte(str))
+  return err
+}
+
+func (ba *ByteArray) WriteBytes(data []byte) error {
+  _, err := ba.Write(data)
+  return err
+}
+
+// WriteObject encodes v in the ObjectEncoding version. Every call has its
+// own reference tables.
+func (ba *ByteArray) WriteObject(v interface{}) error {
+  e := &encodeState{refStore: newRefStore(), version: ba.ObjectEncoding}
+  err := e.marshal(v)
+  if err != nil {
+    return err
+  }
+  return ba.WriteBytes(e.Bytes())
+}
+
+// Compress replaces the content with its compressed form using the zlib
+// or deflate algorithm and moves the position to the end.
+func (ba *ByteArray) Compress(algorithm string) error {
+  var buf bytes.Buffer
+  var w io.WriteCloser
+  switch algorithm {
+  case "", CompressionZlib:
+    w = zlib.NewWriter(&buf)
+  case CompressionDeflate:
+    w, _ = flate.NewWriter(&buf, flate.DefaultCompression)
+  default:
+    return errors.New("Unknown compression algorithm " + algorithm)
+  }
+
+  _, err := w.Write(ba.buf)
+  if err == nil {
+    err = w.Close()
+  }
+  if err != nil {
+    return err
+  }
+
+  ba.buf = buf.Bytes()
+  ba.pos = len(ba.buf)
+  return nil
+}
+
+// Uncompress reverses Compress and moves the position to the start.
+func (ba *ByteArray) Uncompress(algorithm string) error {
+  var r io.ReadCloser
+  var err error
+  switch algorithm {
+  case "", CompressionZlib:
+    r, err = zlib.NewReader(bytes.NewReader(ba.buf))
+  case CompressionDeflate:
+    r = flate.NewReader(bytes.NewReader(ba.buf))
+  default:
+    return errors.New("Unknown compression algorithm " + algorithm)
+  }
+  if err != nil {
+    return err
+  }
+  defer r.Close()
+
+  data, err := ioutil.ReadAll(r)
+  if err != nil {
+    return err
+  }
+
+  ba.buf = data
+  ba.pos = 0
+  return nil
+}
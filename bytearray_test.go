@@ -0,0 +1,74 @@
+package goamf
+
+import (
+  "bytes"
+  "encoding/binary"
+  "testing"
+)
+
+func TestByteArray(t *testing.T) {
+  ba := NewByteArray(nil)
+  ba.WriteInt(-5)
+  ba.WriteUTF("héllo")
+  ba.WriteDouble(1.25)
+  ba.WriteObject(map[string]string{"a": "b"})
+  ba.Endian = binary.LittleEndian
+  ba.WriteShort(0x102)
+
+  ba.SetPosition(0)
+  ba.Endian = binary.BigEndian
+  n, _ := ba.ReadInt()
+  s, _ := ba.ReadUTF()
+  f, _ := ba.ReadDouble()
+  o, err := ba.ReadObject()
+  if n != -5 || s != "héllo" || f != 1.25 || err != nil {
+    t.Fatalf("Got %d %q %v %v", n, s, f, err)
+  }
+  if obj, ok := o.(*AMF3Object); !ok || obj.DynValues["a"] != "b" {
+    t.Fatalf("Got %#v", o)
+  }
+
+  ba.Endian = binary.LittleEndian
+  if short, err := ba.ReadShort(); err != nil || short != 0x102 || ba.BytesAvailable() != 0 {
+    t.Fatalf("Got %x, %v", short, err)
+  }
+  if _, err := ba.ReadByte(); err == nil {
+    t.Fatal("Read past the end")
+  }
+}
+
+func TestByteArrayCompress(t *testing.T) {
+  data := bytes.Repeat([]byte("hello "), 100)
+  for _, algorithm := range []string{CompressionZlib, CompressionDeflate} {
+    ba := NewByteArray(append([]byte(nil), data...))
+    if err := ba.Compress(algorithm); err != nil {
+      t.Fatal(err)
+    }
+    if ba.Len() >= len(data) {
+      t.Fatalf("%s did not compress", algorithm)
+    }
+    if err := ba.Uncompress(algorithm); err != nil {
+      t.Fatal(err)
+    }
+    if !bytes.Equal(ba.Bytes(), data) {
+      t.Fatalf("%s did not survive", algorithm)
+    }
+  }
+}
+
+func TestByteArrayValues(t *testing.T) {
+  ba := NewByteArray([]byte{1, 2, 3})
+  for _, version := range versions {
+    var out []interface{}
+    roundTrip(t, version, []interface{}{ba, []byte("raw")}, &out)
+    if !bytes.Equal(out[0].(*ByteArray).Bytes(), ba.Bytes()) || string(out[1].(*ByteArray).Bytes()) != "raw" {
+      t.Fatalf("AMF%d got %#v", version, out)
+    }
+
+    var typed [][]byte
+    roundTrip(t, version, []interface{}{ba, []byte("raw")}, &typed)
+    if string(typed[1]) != "raw" || !bytes.Equal(typed[0], []byte{1, 2, 3}) {
+      t.Fatalf("AMF%d got %q", version, typed)
+    }
+  }
+}
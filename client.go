@@ -0,0 +1,298 @@
+package goamf
+
+import (
+  "sync"
+  "bytes"
+  "errors"
+  "strconv"
+  "reflect"
+  "context"
+  "time"
+  "strings"
+  "net/http"
+)
+
+// A Client calls the operations of a remoting gateway, the equivalent of
+// NetConnection.call. Every call is answered on its own response URI,
+// "/1", "/2" and so on. With batching, calls made close together share
+// one request packet, as Flash Player merges the calls of one frame.
+type Client struct {
+  baseUrl string
+  version uint16
+  httpClient *http.Client
+  limits *DecodeLimits
+  window time.Duration
+  batchSize int
+
+  mu sync.Mutex
+  url string
+  lastId int
+  headers []PacketHeader
+  pending []*Future
+  timer *time.Timer
+}
+
+// NewClient returns a client of the gateway at url that encodes calls in
+// version.
+func NewClient(url string, version uint16) (*Client, error) {
+  if version != AMF0 && version != AMF3 {
+    return nil, ErrUnsupportedVersion
+  }
+  return &Client{baseUrl: url, url: url, version: version, httpClient: http.DefaultClient}, nil
+}
+
+// SetHTTPClient sets the HTTP client used for requests, which is
+// http.DefaultClient by default. A request only ends early when all of
+// its calls are cancelled, so calls without a deadline need a client with
+// a timeout against gateways that hang.
+func (c *Client) SetHTTPClient(hc *http.Client) {
+  c.httpClient = hc
+}
+
+// SetLimits bounds the resources spent on decoding response packets.
+func (c *Client) SetLimits(limits DecodeLimits) {
+  c.limits = &limits
+}
+
+// SetBatching makes calls wait up to window for further calls, which are
+// then sent in the same request packet. A batch is sent early once it
+// holds size calls, unless size is 0. A window of 0 turns batching off.
+func (c *Client) SetBatching(window time.Duration, size int) {
+  c.mu.Lock()
+  c.window, c.batchSize = window, size
+  c.mu.Unlock()
+  c.Flush()
+}
+
+// A Result is the onResult value of a call.
+type Result struct {
+  Value interface{}
+  version uint16
+}
+
+// Decode stores the result in the value pointed to by v, as
+// Decoder.Decode does.
+func (r *Result) Decode(v interface{}) error {
+  rv := reflect.ValueOf(v)
+  if rv.Kind() != reflect.Ptr || rv.IsNil() {
+    return &InvalidUnmarshalError{reflect.TypeOf(v)}
+  }
+  return assignValue(rv.Elem(), r.Value, r.version)
+}
+
+// A Future is a call on its way to the gateway. Its outcome is known once
+// Done is closed.
+type Future struct {
+  ctx context.Context
+  target string
+  args []interface{}
+  responseUri string
+  done chan struct{}
+  result *Result
+  err error
+}
+
+// Done is closed when the call has completed.
+func (f *Future) Done() <-chan struct{} {
+  return f.done
+}
+
+// Wait waits for the call to complete, or for the context of the call to
+// be done, and returns its outcome as Client.Call does.
+func (f *Future) Wait() (*Result, error) {
+  select {
+  case <-f.done:
+    return f.result, f.err
+  case <-f.ctx.Done():
+    return nil, f.ctx.Err()
+  }
+}
+
+// Call calls target, a service name and an operation joined by a dot,
+// with args, and waits for its outcome. A failed call comes back as an
+// error, which is a *Fault or, from Flex gateways, an *ErrorMessage.
+func (c *Client) Call(ctx context.Context, target string, args ...interface{}) (*Result, error) {
+  return c.Go(ctx, target, args...).Wait()
+}
+
+// Go starts a call of target with args and returns its future without
+// waiting. With batching the call is queued for the next request packet.
+func (c *Client) Go(ctx context.Context, target string, args ...interface{}) *Future {
+  if args == nil {
+    args = []interface{}{}
+  }
+  f := &Future{ctx: ctx, target: target, args: args, done: make(chan struct{})}
+
+  c.mu.Lock()
+  c.lastId++
+  f.responseUri = "/" + strconv.Itoa(c.lastId)
+  if c.window <= 0 {
+    c.mu.Unlock()
+    go c.send([]*Future{f})
+    return f
+  }
+
+  c.pending = append(c.pending, f)
+  if c.batchSize > 0 && len(c.pending) >= c.batchSize {
+    calls := c.takePending()
+    c.mu.Unlock()
+    go c.send(calls)
+    return f
+  }
+  if c.timer == nil {
+    c.timer = time.AfterFunc(c.window, c.Flush)
+  }
+  c.mu.Unlock()
+  return f
+}
+
+// Flush sends the queued calls without waiting for the batching window to
+// end. It does not wait for their outcomes.
+func (c *Client) Flush() {
+  c.mu.Lock()
+  calls := c.takePending()
+  c.mu.Unlock()
+  if len(calls) > 0 {
+    go c.send(calls)
+  }
+}
+
+func (c *Client) takePending() []*Future {
+  if c.timer != nil {
+    c.timer.Stop()
+    c.timer = nil
+  }
+  calls := c.pending
+  c.pending = nil
+  return calls
+}
+
+// send sends the calls whose contexts are not done yet and completes them
+// all. The request is cancelled once the contexts of all its calls are
+// done, as every call may stop waiting on its own.
+func (c *Client) send(calls []*Future) {
+  live := make([]*Future, 0, len(calls))
+  for _, f := range calls {
+    if err := f.ctx.Err(); err != nil {
+      f.err = err
+      close(f.done)
+      continue
+    }
+    live = append(live, f)
+  }
+  if len(live) == 0 {
+    return
+  }
+
+  ctx, cancel := context.WithCancel(context.Background())
+  defer cancel()
+  go func() {
+    for _, f := range live {
+      select {
+      case <-f.ctx.Done():
+      case <-ctx.Done():
+        return
+      }
+    }
+    cancel()
+  }()
+
+  err := c.roundTrip(ctx, live)
+  for _, f := range live {
+    if err != nil {
+      f.result, f.err = nil, err
+    }
+    close(f.done)
+  }
+}
+
+// roundTrip sends calls in one request packet and sets their outcomes
+// from the response packet.
+func (c *Client) roundTrip(ctx context.Context, calls []*Future) error {
+  url, headers := c.requestTarget()
+  req, err := NewAmfPacket(c.version)
+  if err != nil {
+    return err
+  }
+  req.Headers = append(req.Headers, headers...)
+  for _, f := range calls {
+    err = req.AddMessage(f.target, f.responseUri, f.args)
+    if err != nil {
+      return err
+    }
+  }
+
+  resp, err := c.post(ctx, url, req)
+  if err != nil {
+    return err
+  }
+  c.handleHeaders(resp.Headers, resp.Version)
+
+  responses := make(map[string]PacketMessage, len(resp.Messages))
+  for _, message := range resp.Messages {
+    responses[message.TargetUri] = message
+  }
+  for _, f := range calls {
+    if message, ok := responses[f.responseUri + "/onResult"]; ok {
+      f.result = &Result{message.Value, resp.Version}
+    } else if message, ok := responses[f.responseUri + "/onStatus"]; ok {
+      f.err = statusError(message.Value, resp.Version)
+    } else {
+      f.err = errors.New("The gateway did not answer the call of " + f.target)
+    }
+  }
+  return nil
+}
+
+func (c *Client) post(ctx context.Context, url string, req *Packet) (*Packet, error) {
+  data, err := MarshalPacket(req)
+  if err != nil {
+    return nil, err
+  }
+
+  hr, err := http.NewRequest("POST", url, bytes.NewReader(data))
+  if err != nil {
+    return nil, err
+  }
+  hr = hr.WithContext(ctx)
+  hr.Header.Set("Content-Type", AMFContentType)
+
+  hresp, err := c.httpClient.Do(hr)
+  if err != nil {
+    return nil, err
+  }
+  defer hresp.Body.Close()
+
+  if hresp.StatusCode != http.StatusOK {
+    return nil, errors.New("The gateway responded " + hresp.Status)
+  }
+  if ct := hresp.Header.Get("Content-Type"); !strings.HasPrefix(ct, AMFContentType) {
+    return nil, errors.New("The gateway responded with content type " + ct)
+  }
+
+  dec := NewDecoder(hresp.Body, AMF0)
+  if c.limits != nil {
+    dec.SetLimits(*c.limits)
+  }
+  return dec.DecodePacket()
+}
+
+// statusError turns an onStatus value into an error.
+func statusError(v interface{}, version uint16) error {
+  switch e := v.(type) {
+  case *ErrorMessage:
+    return e
+  case *Fault:
+    return e
+  }
+
+  if str, ok := v.(string); ok {
+    return &Fault{"error", "", str, ""}
+  }
+
+  fault := &Fault{}
+  if assignValue(reflect.ValueOf(fault).Elem(), v, version) != nil || (fault.Code == "" && fault.Description == "") {
+    fault = &Fault{"error", "", "The call failed with a status " + describeValue(v), ""}
+  }
+  return fault
+}
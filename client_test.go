@@ -0,0 +1,243 @@
+package goamf
+
+import (
+  "sync"
+  "errors"
+  "context"
+  "testing"
+  "time"
+  "net/http"
+  "net/http/httptest"
+)
+
+// countingHandler counts the requests that reach h and records their URLs.
+type countingHandler struct {
+  h http.Handler
+  mu sync.Mutex
+  urls []string
+}
+
+func (c *countingHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+  c.mu.Lock()
+  c.urls = append(c.urls, r.URL.String())
+  c.mu.Unlock()
+  c.h.ServeHTTP(w, r)
+}
+
+func (c *countingHandler) requests() []string {
+  c.mu.Lock()
+  defer c.mu.Unlock()
+  return append([]string(nil), c.urls...)
+}
+
+func newTestServer(g *Gateway) (*httptest.Server, *countingHandler) {
+  h := &countingHandler{h: g}
+  return httptest.NewServer(h), h
+}
+
+func TestClientCall(t *testing.T) {
+  srv, _ := newTestServer(newTestGateway())
+  defer srv.Close()
+
+  for _, version := range versions {
+    c, err := NewClient(srv.URL, version)
+    if err != nil {
+      t.Fatal(err)
+    }
+
+    r, err := c.Call(context.Background(), "Echo.echo", "a", 2)
+    if err != nil {
+      t.Fatal(err)
+    }
+    var out []interface{}
+    if err := r.Decode(&out); err != nil || len(out) != 2 {
+      t.Fatalf("AMF%d got %#v, %v", version, r.Value, err)
+    }
+    var n int
+    if out[0] != "a" || (&Result{out[1], version}).Decode(&n) != nil || n != 2 {
+      t.Fatalf("AMF%d got %#v", version, out)
+    }
+
+    _, err = c.Call(context.Background(), "Echo.fail")
+    if f, ok := err.(*Fault); !ok || f.Code != "App.Failed" || f.Description != "failed" {
+      t.Fatalf("AMF%d got %#v", version, err)
+    }
+  }
+
+  if _, err := NewClient(srv.URL, 2); err != ErrUnsupportedVersion {
+    t.Fatalf("Got %v", err)
+  }
+}
+
+func TestClientHTTPErrors(t *testing.T) {
+  srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    if r.URL.Path == "/text" {
+      w.Write([]byte("hello"))
+      return
+    }
+    http.Error(w, "nope", http.StatusInternalServerError)
+  }))
+  defer srv.Close()
+
+  for _, url := range []string{srv.URL + "/fail", srv.URL + "/text"} {
+    c, _ := NewClient(url, AMF0)
+    if _, err := c.Call(context.Background(), "Echo.echo"); err == nil {
+      t.Fatalf("%s: the call succeeded", url)
+    }
+  }
+}
+
+func TestClientBatching(t *testing.T) {
+  srv, h := newTestServer(newTestGateway())
+  defer srv.Close()
+
+  c, _ := NewClient(srv.URL, AMF3)
+  c.SetBatching(50 * time.Millisecond, 0)
+
+  var futures []*Future
+  for _, s := range []string{"a", "b", "c"} {
+    futures = append(futures, c.Go(context.Background(), "Echo.echo", s))
+  }
+  futures = append(futures, c.Go(context.Background(), "Echo.fail"))
+  for i, s := range []string{"a", "b", "c"} {
+    r, err := futures[i].Wait()
+    var args []string
+    if err != nil || r.Decode(&args) != nil || len(args) != 1 || args[0] != s {
+      t.Fatalf("Call %d got %#v, %v", i, r, err)
+    }
+  }
+  if _, err := futures[3].Wait(); err == nil {
+    t.Fatal("The failing call of the batch succeeded")
+  }
+  if n := len(h.requests()); n != 1 {
+    t.Fatalf("The batch took %d requests", n)
+  }
+
+  // A full batch goes out at once, the rest waits for Flush.
+  c.SetBatching(time.Hour, 2)
+  futures = futures[:0]
+  for _, s := range []string{"a", "b", "c"} {
+    futures = append(futures, c.Go(context.Background(), "Echo.echo", s))
+  }
+  futures[0].Wait()
+  futures[1].Wait()
+  select {
+  case <-futures[2].Done():
+    t.Fatal("The call was sent before the batch was full")
+  case <-time.After(20 * time.Millisecond):
+  }
+
+  c.Flush()
+  if _, err := futures[2].Wait(); err != nil {
+    t.Fatal(err)
+  }
+  if n := len(h.requests()); n != 3 {
+    t.Fatalf("Got %d requests", n)
+  }
+}
+
+func TestClientCancel(t *testing.T) {
+  cancelled := make(chan struct{})
+  g := NewGateway()
+  g.HandleFunc("Slow.wait", func(ctx context.Context, args []interface{}) (interface{}, error) {
+    <-ctx.Done()
+    close(cancelled)
+    return nil, ctx.Err()
+  })
+  srv := httptest.NewServer(g)
+  defer srv.Close()
+
+  c, _ := NewClient(srv.URL, AMF0)
+  ctx, cancel := context.WithTimeout(context.Background(), 20 * time.Millisecond)
+  defer cancel()
+  if _, err := c.Call(ctx, "Slow.wait"); !errors.Is(err, context.DeadlineExceeded) {
+    t.Fatalf("Got %v", err)
+  }
+
+  // The request is abandoned with its only call.
+  select {
+  case <-cancelled:
+  case <-time.After(5 * time.Second):
+    t.Fatal("The gateway did not notice the cancelled call")
+  }
+
+  ctx, cancel = context.WithCancel(context.Background())
+  cancel()
+  if _, err := c.Call(ctx, "Slow.wait"); !errors.Is(err, context.Canceled) {
+    t.Fatalf("Got %v", err)
+  }
+}
+
+func TestClientHeaders(t *testing.T) {
+  g := NewGateway()
+  g.UnderstandHeaders("Session")
+  g.SetCredentialsHandler(func(ctx context.Context, userid, password string) error {
+    if userid != "bob" || password != "secret" {
+      return errors.New("Wrong password")
+    }
+    return nil
+  })
+  g.HandleFunc("Session.login", func(ctx context.Context, args []interface{}) (interface{}, error) {
+    AddResponseHeader(ctx, HeaderRequestPersistentHeader, false, &PersistentHeader{"Session", true, "abc"})
+    return nil, nil
+  })
+  g.HandleFunc("Session.get", func(ctx context.Context, args []interface{}) (interface{}, error) {
+    AddResponseHeader(ctx, HeaderAppendToGatewayUrl, false, "?sid=1")
+    v, _ := HeaderFromContext(ctx, "Session")
+    return v, nil
+  })
+  srv, h := newTestServer(g)
+  defer srv.Close()
+
+  for _, version := range versions {
+    c, _ := NewClient(srv.URL + "/gateway", version)
+    if _, err := c.Call(context.Background(), "Session.login"); err == nil {
+      t.Fatal("The call succeeded without credentials")
+    }
+
+    c.SetCredentials("bob", "secret")
+    if _, err := c.Call(context.Background(), "Session.login"); err != nil {
+      t.Fatal(err)
+    }
+
+    // Gateways repeat AppendToGatewayUrl, which must not pile up.
+    for i := 0; i < 3; i++ {
+      r, err := c.Call(context.Background(), "Session.get")
+      if err != nil || r.Value != "abc" {
+        t.Fatalf("AMF%d got %#v, %v", version, r, err)
+      }
+    }
+    urls := h.requests()
+    if got := urls[len(urls) - 1]; got != "/gateway?sid=1" {
+      t.Fatalf("AMF%d got the URL %s", version, got)
+    }
+
+    c.AddHeader("Session", false, nil)
+    if r, err := c.Call(context.Background(), "Session.get"); err != nil || r.Value != nil {
+      t.Fatalf("AMF%d got %#v, %v", version, r, err)
+    }
+  }
+}
+
+func TestClientReplaceGatewayUrl(t *testing.T) {
+  next, h := newTestServer(newTestGateway())
+  defer next.Close()
+
+  g := NewGateway()
+  g.HandleFunc("Echo.echo", func(ctx context.Context, args []interface{}) (interface{}, error) {
+    AddResponseHeader(ctx, HeaderReplaceGatewayUrl, false, next.URL + "/moved")
+    return args, nil
+  })
+  first := httptest.NewServer(g)
+  defer first.Close()
+
+  c, _ := NewClient(first.URL, AMF0)
+  for i := 0; i < 2; i++ {
+    if _, err := c.Call(context.Background(), "Echo.echo", i); err != nil {
+      t.Fatal(err)
+    }
+  }
+  if urls := h.requests(); len(urls) != 1 || urls[0] != "/moved" {
+    t.Fatalf("Got %v", urls)
+  }
+}
@@ -1,41 +1,186 @@
 package goamf
 
 import (
-  "log"
+  "io"
+  "math"
+  "bufio"
   "bytes"
   "errors"
+  "reflect"
   "runtime"
+  "encoding/binary"
 )
 
-func unmarshal(version uint16, data []byte) (interface{}, error) {
-  d := &decodeState{
-    bytes.NewBuffer(data),
-    new(refStore),
-    version,
+// UnmarshalPacket decodes an AMF packet. Headers and bodies are read the
+// way Flash Player writes them, see Packet.
+func UnmarshalPacket(data []byte) (*Packet, error) {
+  return NewDecoder(bytes.NewBuffer(data), AMF0).DecodePacket()
+}
+
+// UnmarshalValue decodes a single AMF value of the version from data, such
+// as an RTMP command argument or an FLV script tag value.
+func UnmarshalValue(data []byte, version uint16) (interface{}, error) {
+  if version != AMF0 && version != AMF3 {
+    return nil, ErrUnsupportedVersion
   }
-  return unmarshalPacket(d)
+  return NewDecoder(bytes.NewBuffer(data), version).d.unmarshal()
 }
 
-var Unmarshal = UnmarshalAmf0
+// Unmarshal decodes a single AMF0 value from data and stores it in the
+// value pointed to by v.
+func Unmarshal(data []byte, v interface{}) error {
+  return NewDecoder(bytes.NewBuffer(data), AMF0).Decode(v)
+}
 
+// UnmarshalAmf0 decodes a single AMF0 value, the counterpart of
+// MarshalAmf0.
 func UnmarshalAmf0(data []byte) (interface{}, error) {
-  return unmarshal(AMF0, data)
+  return UnmarshalValue(data, AMF0)
 }
 
+// UnmarshalAmf3 decodes a single AMF3 value, the counterpart of
+// MarshalAmf3.
 func UnmarshalAmf3(data []byte) (interface{}, error) {
-  return unmarshal(AMF3, data)
+  return UnmarshalValue(data, AMF3)
 }
 
 type decodeState struct {
-  *bytes.Buffer
+  Reader
   *refStore
+  avmPlusRefs *refStore
   version uint16
+  limits *DecodeLimits
+  depth int
+}
+
+// Unmarshaler is implemented by types that read their own AMF encoding.
+// At the top level UnmarshalAMF reads from the stream itself. Nested in an
+// object or array the value has already been decoded, and the Decoder
+// passed in replays it to a single Decode call, while Read fails. So a
+// Marshaler only writes raw bytes at the top level.
+type Unmarshaler interface {
+  UnmarshalAMF(dec *Decoder) error
+}
+
+var unmarshalerType = reflect.TypeOf(new(Unmarshaler)).Elem()
+
+// A Decoder reads AMF values of one version from an input stream. The
+// string, object and traits reference tables are kept across calls to
+// Decode, so successive values may refer to earlier ones. The tables grow
+// with every value and are bounded by DecodeLimits.MaxReferences, so a
+// long-lived stream should call ResetReferences at message boundaries, in
+// step with its Encoder.
+type Decoder struct {
+  d *decodeState
+  replay *replayValue
+}
+
+// replayValue is a value decoded ahead of its Unmarshaler.
+type replayValue struct {
+  a *assignState
+  value interface{}
+  path string
+}
+
+// NewDecoder returns a decoder reading from r. If r does not implement
+// io.ByteReader it is buffered, and the decoder may read past the values
+// it returns.
+func NewDecoder(r io.Reader, version uint16) *Decoder {
+  br, ok := r.(Reader)
+  if !ok {
+    br = bufio.NewReader(r)
+  }
+
+  return &Decoder{d: &decodeState{Reader: &countingReader{r: br}, refStore: newRefStore(), version: version}}
+}
+
+// SetLimits bounds the resources the decoder spends on its input, which
+// guards against hostile payloads. The byte budget covers all input read
+// by the decoder.
+func (dec *Decoder) SetLimits(limits DecodeLimits) {
+  if dec.d == nil {
+    return
+  }
+
+  dec.d.limits = &limits
+  if cr, ok := dec.d.Reader.(*countingReader); ok {
+    cr.max = limits.MaxBytes
+  }
+}
+
+// Decode reads the next AMF value and stores it in the value pointed to
+// by v. Structs, slices, maps and pointers are filled from the decoded
+// objects and arrays, and numbers are converted to the Go type of the
+// target.
+func (dec *Decoder) Decode(v interface{}) error {
+  rv := reflect.ValueOf(v)
+  if rv.Kind() != reflect.Ptr || rv.IsNil() {
+    return &InvalidUnmarshalError{reflect.TypeOf(v)}
+  }
+
+  if dec.replay != nil {
+    return dec.replay.a.assign(rv.Elem(), dec.replay.value, dec.replay.path)
+  }
+
+  if u, ok := v.(Unmarshaler); ok {
+    return u.UnmarshalAMF(dec)
+  }
+
+  dec.d.avmPlusRefs = nil
+  value, err := dec.d.unmarshal()
+  if err != nil {
+    return err
+  }
+  return assignValue(rv.Elem(), value, dec.d.version)
+}
+
+var errReplay = errors.New("The decoder of a nested Unmarshaler can not read the stream")
+
+// Read reads raw bytes from the stream.
+func (dec *Decoder) Read(p []byte) (int, error) {
+  if dec.replay != nil {
+    return 0, errReplay
+  }
+  return dec.d.Read(p)
+}
+
+func (dec *Decoder) ReadByte() (byte, error) {
+  if dec.replay != nil {
+    return 0, errReplay
+  }
+  return dec.d.ReadByte()
+}
+
+// Version returns the AMF version of the stream.
+func (dec *Decoder) Version() uint16 {
+  if dec.replay != nil {
+    return dec.replay.a.version
+  }
+  return dec.d.version
+}
+
+// DecodePacket reads an AMF packet from the stream. Headers and bodies are
+// AMF0 values with reference tables of their own, which switch to AMF3 at
+// the AVM+ marker, whatever the version of the decoder.
+func (dec *Decoder) DecodePacket() (*Packet, error) {
+  if dec.replay != nil {
+    return nil, errReplay
+  }
+  return unmarshalPacket(dec.d)
+}
+
+// ResetReferences clears the string, object and traits reference tables,
+// where the encoder of the stream reset its own.
+func (dec *Decoder) ResetReferences() {
+  if dec.d != nil {
+    dec.d.refStore, dec.d.avmPlusRefs = newRefStore(), nil
+  }
 }
 
 func unmarshalPacket(d *decodeState) (p *Packet, err error) {
   version, err := readU16(d)
   if err == nil && version != AMF0 && version != AMF3 {
-    err = errors.New("AMF version should be 0 or 3")
+    err = ErrUnsupportedVersion
   }
   if err != nil {
     return nil, err
@@ -45,6 +190,11 @@ func unmarshalPacket(d *decodeState) (p *Packet, err error) {
   if err != nil {
     return
   }
+
+  defer func(version uint16, refS *refStore) {
+    d.version, d.refStore, d.avmPlusRefs = version, refS, nil
+  }(d.version, d.refStore)
+  d.version = AMF0
   
   headerCount, err := readU16(d)
   for index := uint16(0); index < headerCount; index++ {
@@ -63,23 +213,9 @@ func unmarshalPacket(d *decodeState) (p *Packet, err error) {
       return nil, err
     }
     
-    var v interface{}
-    if length == uint32(0xffffffff) {
-      v, err = d.unmarshal()
-      if err != nil {
-        return nil, err
-      }
-    } else {
-      data := make([]byte, length)
-      _, err = d.Read(data)
-      if err != nil {
-        return nil, err
-      }
-      
-      v, err = d.unmarshalNew(data)
-      if err != nil {
-        return nil, err
-      }
+    v, err := d.unmarshalPacketValue(length)
+    if err != nil {
+      return nil, keyPath(elemPath(err, int(index)), "headers")
     }
     err = p.AddHeader(headerName, mustUnderstand, v)
     if err != nil {
@@ -104,23 +240,10 @@ func unmarshalPacket(d *decodeState) (p *Packet, err error) {
       return nil, err
     }
     
-    var v interface{}
-    if length == uint32(0xffffffff) {
-      v, err = d.unmarshal()
-      if err != nil {
-        return nil, err
-      }
-    } else {
-      data := make([]byte, length)
-      _, err = d.Read(data)
-      if err != nil {
-        return nil, err
-      }
-      
-      v, err = d.unmarshalNew(data)
-      if err != nil {
-        return nil, err
-      }
+    
+    v, err := d.unmarshalPacketValue(length)
+    if err != nil {
+      return nil, keyPath(elemPath(keyPath(err, "body"), int(index)), "messages")
     }
     
     err = p.AddMessage(targetUri, responseUri, v)
@@ -133,42 +256,73 @@ func unmarshalPacket(d *decodeState) (p *Packet, err error) {
 }
 
 func (d *decodeState) unmarshal() (v interface{}, err error) {
+  var marker byte
   defer func() {
     if r := recover(); r != nil {
       if _, ok := r.(runtime.Error); ok {
         panic(r)
       }
-      if s, ok := r.(string); ok {
-        panic(s)
+      if e, ok := r.(error); ok {
+        v, err = nil, d.decodeError(marker, e)
+      } else {
+        panic(r)
       }
-      err = r.(error)
     }
   }()
-  
-  f, err := typeDecoder(d)
+
+  marker, f, err := typeDecoder(d)
+  if err == nil && f == nil {
+    err = ErrUnsupportedMarker
+  }
   if err != nil {
-    log.Println(err)
-    return nil, err
+    return nil, d.decodeError(marker, err)
   }
-  
-  return f(d)
+
+  d.depth++
+  defer func() {
+    d.depth--
+  }()
+  if d.depth > d.maxDepth() {
+    return nil, d.decodeError(marker, &LimitError{"MaxDepth", int64(d.depth), int64(d.maxDepth())})
+  }
+
+  v, err = f(d)
+  if err != nil {
+    return nil, d.decodeError(marker, err)
+  }
+  return v, nil
 }
 
-func (d *decodeState) unmarshalNew(data []byte) (interface{}, error){
+// unmarshalPacketValue decodes a packet header or body value of length
+// bytes, or up to its end when the length is unknown. Every value has its
+// own reference tables.
+func (d *decodeState) unmarshalPacketValue(length uint32) (interface{}, error) {
+  d.refStore, d.avmPlusRefs = newRefStore(), nil
+  if length == 0xffffffff {
+    return d.unmarshal()
+  }
+
+  data, err := d.readBytes(int64(length))
+  if err != nil {
+    return nil, err
+  }
+
   d2 := &decodeState {
-    bytes.NewBuffer(data),
-    d.refStore,
-    d.version,
+    Reader: &countingReader{r: bytes.NewBuffer(data), n: d.offset() - int64(len(data))},
+    refStore: d.refStore,
+    version: d.version,
+    limits: d.limits,
+    depth: d.depth,
   }
-  
   return d2.unmarshal()
 }
 
 type decoderFunc func(d *decodeState) (v interface{}, err error)
 
-func typeDecoder(d *decodeState) (f decoderFunc, err error) {
-  f = nil
-  marker, err := d.ReadByte()
+// typeDecoder reads the marker of the next value and returns its decoder.
+// The decoder is nil for markers that are not known.
+func typeDecoder(d *decodeState) (marker byte, f decoderFunc, err error) {
+  marker, err = d.ReadByte()
   if err != nil {
     return
   }
@@ -179,18 +333,18 @@ func typeDecoder(d *decodeState) (f decoderFunc, err error) {
     case AMF0_BOOLEAN_MARKER: f = amf0BooleanDecoder
     case AMF0_STRING_MARKER: f = amf0StringDecoder
     case AMF0_OBJECT_MARKER: f = amf0ObjectDecoder
-    case AMF0_MOVIECLIP_MARKER: err = errors.New("Movie Clip mark is not supported yet")
+    case AMF0_MOVIECLIP_MARKER: err = ErrUnsupportedMarker
     case AMF0_NULL_MARKER: f = amf0NullDecoder
     case AMF0_UNDEFINED_MARKER: f = amf0UndefindedDecoder
-    case AMF0_REFERENCE_MARKER: err = errors.New("Reference mark is not supported yet")
-    case AMF0_ECMA_ARRAY_MARKER: err = errors.New("ECMA array mark is not supported yet")
-    case AMF0_OBJECT_END_MARKER: err = errors.New("It shouldn't only occur object end mark")
+    case AMF0_REFERENCE_MARKER: err = ErrUnsupportedMarker
+    case AMF0_ECMA_ARRAY_MARKER: f = amf0ECMAArrayDecoder
+    case AMF0_OBJECT_END_MARKER: err = ErrUnsupportedMarker
     case AMF0_STRICT_ARRAY_MARKER: f = amf0StrictArrayDecoder
-    case AMF0_DATE_MARKER: err = errors.New("Date mark is not supported yet")
+    case AMF0_DATE_MARKER: f = amf0DateDecoder
     case AMF0_LONG_STRING_MARKER: f = amf0LongString
-    case AMF0_UNSUPPORTED_MARKER: err = errors.New("Unsupported mark is not supported yet")
-    case AMF0_RECORDSET_MARKER: err = errors.New("Record Set mark is not supported yet")
-    case AMF0_XML_DOCUMENT_MARKER: err = errors.New("XML Document mark is not supported yet")
+    case AMF0_UNSUPPORTED_MARKER: err = ErrUnsupportedMarker
+    case AMF0_RECORDSET_MARKER: err = ErrUnsupportedMarker
+    case AMF0_XML_DOCUMENT_MARKER: f = amf0XMLDocumentDecoder
     case AMF0_TYPED_OBJECT_MARKER: f = amf0TypedObjectDecoder
     case AMF0_ACMPLUS_OBJECT_MARKER: f = amf0AcmPlusObjectDecoder
     }
@@ -203,12 +357,17 @@ func typeDecoder(d *decodeState) (f decoderFunc, err error) {
     case AMF3_INTEGER_MARKER: f = amf3IntegerDecoder
     case AMF3_DOUBLE_MARKER: f = amf3DoubleDecoder
     case AMF3_STRING_MARKER: f = amf3StringDecoder
-    case AMF3_XMLDOC_MARKER: err = errors.New("AMF3 XML Document mark is not supported yet")
-    case AMF3_DATE_MARKER: err = errors.New("AMF3 Date mark is not supported yet")
+    case AMF3_XMLDOC_MARKER: f = amf3XMLDocumentDecoder
+    case AMF3_DATE_MARKER: f = amf3DateDecoder
     case AMF3_ARRAY_MARKER: f = amf3ArrayDecoder
     case AMF3_OBJECT_MARKER: f = amf3ObjectDecoder
-    case AMF3_XML_MARKER: err = errors.New("AMF3 XML mark is not supported yet")
-    case AMF3_BYTEARRAY_MARKER: err = errors.New("AMF3 Byte Array mark is not supported yet")
+    case AMF3_XML_MARKER: f = amf3XMLDecoder
+    case AMF3_BYTEARRAY_MARKER: f = amf3ByteArrayDecoder
+    case AMF3_VECTOR_INT_MARKER: f = amf3VectorDecoder(marker)
+    case AMF3_VECTOR_UINT_MARKER: f = amf3VectorDecoder(marker)
+    case AMF3_VECTOR_DOUBLE_MARKER: f = amf3VectorDecoder(marker)
+    case AMF3_VECTOR_OBJECT_MARKER: f = amf3VectorDecoder(marker)
+    case AMF3_DICTIONARY_MARKER: f = amf3DictionaryDecoder
     }
   }
   return
@@ -231,9 +390,9 @@ func amf0StringDecoder(d *decodeState) (interface{}, error) {
 }
 
 func amf0ObjectDecoder(d *decodeState) (interface{}, error) {
-  obj := make(AMF0Object)
-  
-  err := readObjectProperty(d, obj)
+  obj := NewAMF0Object()
+
+  err := readObjectProperty(d, obj.AddValue)
     
   return obj, err
 }
@@ -246,17 +405,34 @@ func amf0UndefindedDecoder(d *decodeState) (interface{}, error) {
   return Undefined{}, nil
 }
 
+func amf0ECMAArrayDecoder(d *decodeState) (interface{}, error) {
+  count, err := readU32(d)
+  if err != nil {
+    return nil, err
+  }
+
+  arr := NewAMF0ECMAArray(uint32(capHint(count)))
+  arr.Count = count
+  err = readObjectProperty(d, arr.AddValue)
+  return arr, err
+}
+
 func amf0StrictArrayDecoder(d *decodeState) (interface{}, error) {
   count, err := readU32(d)
   if err != nil {
     return nil, err
   }
   
-  arr := make([]interface{}, 0, count)
+  err = d.checkArray(count)
+  if err != nil {
+    return nil, err
+  }
+  
+  arr := make([]interface{}, 0, capHint(count))
   for i := uint32(0); i < count; i++ {
     v, err := d.unmarshal()
     if err != nil {
-      return nil, err
+      return nil, elemPath(err, int(i))
     }
     
     arr = append(arr, v)
@@ -264,10 +440,19 @@ func amf0StrictArrayDecoder(d *decodeState) (interface{}, error) {
   return arr, nil
 }
 
+func amf0DateDecoder(d *decodeState) (interface{}, error) {
+  return readDate(d)
+}
+
 func amf0LongString(d *decodeState) (interface{}, error) {
   return readLongUTF8(d)
 }
 
+func amf0XMLDocumentDecoder(d *decodeState) (interface{}, error) {
+  str, err := readLongUTF8(d)
+  return XMLDocument(str), err
+}
+
 func amf0TypedObjectDecoder(d *decodeState) (interface{}, error) {
   className, err := readUTF8(d)
   if err != nil {
@@ -275,23 +460,28 @@ func amf0TypedObjectDecoder(d *decodeState) (interface{}, error) {
   }
   
   obj := NewAMF0TypedObject(className)
-  err = readObjectProperty(d, obj.values)
-  return obj, err
+  err = readObjectProperty(d, obj.AddValue)
+  if err != nil {
+    return nil, err
+  }
+
+  if t, ok := aliasType(className); ok {
+    v := reflect.New(t)
+    return v.Interface(), assignValue(v.Elem(), obj, d.version)
+  }
+  return obj, nil
 }
 
 func amf0AcmPlusObjectDecoder(d *decodeState) (interface{}, error) {
-  version := d.version
-  refS := d.refStore
-  d.version = AMF3
-  d.refStore = new(refStore)
-  f, err := typeDecoder(d)
-  if err != nil {
-    return nil, err
+  if d.avmPlusRefs == nil {
+    d.avmPlusRefs = newRefStore()
   }
-  obj, err := f(d)
-  d.version = version
-  d.refStore = refS
-  return obj, err
+  version, refS := d.version, d.refStore
+  d.version, d.refStore = AMF3, d.avmPlusRefs
+  defer func() {
+    d.version, d.refStore = version, refS
+  }()
+  return d.unmarshal()
 }
 
 //
@@ -316,7 +506,8 @@ func amf3TrueDecoder(d *decodeState) (interface{}, error) {
 
 func amf3IntegerDecoder(d *decodeState) (interface{}, error) {
   u29, err := readU29(d)
-  return int32(u29), err
+  // Sign extend the 29-bit two's complement integer
+  return int32(u29 << 3) >> 3, err
 }
 
 func amf3DoubleDecoder(d *decodeState) (interface{}, error) {
@@ -327,6 +518,48 @@ func amf3StringDecoder(d *decodeState) (interface{}, error) {
   return readUTF8Vr(d)
 }
 
+func amf3XMLDocumentDecoder(d *decodeState) (interface{}, error) {
+  str, ref, err := readXML(d)
+  if err != nil || ref != nil {
+    return ref, err
+  }
+
+  doc := XMLDocument(str)
+  d.addObjectRef(doc)
+  return doc, nil
+}
+
+func amf3XMLDecoder(d *decodeState) (interface{}, error) {
+  str, ref, err := readXML(d)
+  if err != nil || ref != nil {
+    return ref, err
+  }
+
+  x := XML(str)
+  d.addObjectRef(x)
+  return x, nil
+}
+
+func amf3DateDecoder(d *decodeState) (interface{}, error) {
+  u29, err := readU29(d)
+  if err != nil {
+    return nil, err
+  }
+
+  if u29 & 0x01 == 0 {
+    return d.getObjectRef(u29 >> 1)
+  }
+
+  ms, err := readDouble(d)
+  if err != nil {
+    return nil, err
+  }
+
+  t := msToTime(ms)
+  d.addObjectRef(t)
+  return t, nil
+}
+
 func amf3ArrayDecoder(d *decodeState) (interface{}, error) {
   length, err := readU29(d)
   if err != nil {
@@ -339,7 +572,13 @@ func amf3ArrayDecoder(d *decodeState) (interface{}, error) {
   }
   
   length = length >> 1
-  arr := NewAMF3Array(uint(length))
+  err = d.checkArray(length)
+  if err != nil {
+    return nil, err
+  }
+
+  arr := NewAMF3Array(uint(capHint(length)))
+  d.addObjectRef(arr)
   for {
     k, v, err := readAssocValue(d)
     if err != nil {
@@ -351,93 +590,232 @@ func amf3ArrayDecoder(d *decodeState) (interface{}, error) {
     }
     
     arr.AddAssocValue(k, v)
+    err = d.checkMembers(len(arr.AssocValues))
+    if err != nil {
+      return nil, err
+    }
   }
   
   for i := uint32(0); i < length; i++ {
     v, err := d.unmarshal()
     if err != nil {
-      return nil, err
+      return nil, elemPath(err, int(i))
     }
     
     arr.AddDenseValue(v)
   }
   
-  d.addObjectRef(arr)
   return arr, nil
 }
 
+func amf3VectorDecoder(marker byte) decoderFunc {
+  return func(d *decodeState) (interface{}, error) {
+    u29, err := readU29(d)
+    if err != nil {
+      return nil, err
+    }
+
+    if u29 & 0x01 == 0 {
+      return d.getObjectRef(u29 >> 1)
+    }
+
+    fixed, err := readBoolean(d)
+    if err != nil {
+      return nil, err
+    }
+
+    length := u29 >> 1
+    err = d.checkArray(length)
+    if err != nil {
+      return nil, err
+    }
+
+    vec := &Vector{Fixed: fixed}
+    d.addObjectRef(vec)
+    switch marker {
+    case AMF3_VECTOR_INT_MARKER:
+      data, err := d.readBytes(int64(length) * 4)
+      if err != nil {
+        return nil, err
+      }
+      values := make([]int32, length)
+      for i := range values {
+        values[i] = int32(binary.BigEndian.Uint32(data[i*4:]))
+      }
+      vec.Values = values
+    case AMF3_VECTOR_UINT_MARKER:
+      data, err := d.readBytes(int64(length) * 4)
+      if err != nil {
+        return nil, err
+      }
+      values := make([]uint32, length)
+      for i := range values {
+        values[i] = binary.BigEndian.Uint32(data[i*4:])
+      }
+      vec.Values = values
+    case AMF3_VECTOR_DOUBLE_MARKER:
+      data, err := d.readBytes(int64(length) * 8)
+      if err != nil {
+        return nil, err
+      }
+      values := make([]float64, length)
+      for i := range values {
+        values[i] = math.Float64frombits(binary.BigEndian.Uint64(data[i*8:]))
+      }
+      vec.Values = values
+    default:
+      vec.TypeName, err = readUTF8Vr(d)
+      if err != nil {
+        return nil, err
+      }
+
+      values := make([]interface{}, 0, capHint(length))
+      for i := uint32(0); i < length; i++ {
+        v, err := d.unmarshal()
+        if err != nil {
+          return nil, elemPath(err, int(i))
+        }
+        values = append(values, v)
+      }
+      vec.Values = values
+    }
+
+    if err != nil {
+      return nil, err
+    }
+    return vec, nil
+  }
+}
+
+func amf3DictionaryDecoder(d *decodeState) (interface{}, error) {
+  u29, err := readU29(d)
+  if err != nil {
+    return nil, err
+  }
+
+  if u29 & 0x01 == 0 {
+    return d.getObjectRef(u29 >> 1)
+  }
+
+  weakKeys, err := readBoolean(d)
+  if err != nil {
+    return nil, err
+  }
+
+  length := u29 >> 1
+  err = d.checkArray(length)
+  if err != nil {
+    return nil, err
+  }
+
+  dict := &Dictionary{weakKeys, make([]DictionaryEntry, 0, capHint(length))}
+  d.addObjectRef(dict)
+  for i := uint32(0); i < length; i++ {
+    k, err := d.unmarshal()
+    if err != nil {
+      return nil, keyPath(elemPath(err, int(i)), "key")
+    }
+
+    v, err := d.unmarshal()
+    if err != nil {
+      return nil, keyPath(elemPath(err, int(i)), "value")
+    }
+    dict.Entries = append(dict.Entries, DictionaryEntry{k, v})
+  }
+  return dict, nil
+}
+
+func amf3ByteArrayDecoder(d *decodeState) (interface{}, error) {
+  u29, err := readU29(d)
+  if err != nil {
+    return nil, err
+  }
+
+  if u29 & 0x01 == 0 {
+    return d.getObjectRef(u29 >> 1)
+  }
+
+  err = d.checkString(u29 >> 1)
+  if err != nil {
+    return nil, err
+  }
+
+  data, err := d.readBytes(int64(u29 >> 1))
+  if err != nil {
+    return nil, err
+  }
+
+  ba := NewByteArray(data)
+  d.addObjectRef(ba)
+  return ba, nil
+}
+
 func amf3ObjectDecoder(d *decodeState) (interface{}, error) {
-  var obj *AMF3Object
+  var traits *Traits
   u29, err := readU29(d)
   if err != nil {
     return nil, err
   }
 
   if u29 & 0x01 == 0x00 {
-    return nil, errors.New("Not support unmarshal for object reference")
+    return d.getObjectRef(u29 >> 1)
   } else if u29 & 0x03 == 0x01 {
-    obj, err = d.getTraitsRef(u29 >> 2)
+    traits, err = d.getTraitsRef(u29 >> 2)
     if err != nil {
       return nil, err
     }
-    
-    for _, k := range obj.keys {
-      v, err := d.unmarshal()
-      if err != nil {
-        return nil, err
-      }
-      obj.AddValue(k, v)
-    }
-    if len(obj.keys) != len(obj.Values) {
-      return nil, errors.New("The traits ref object's length of keys and values is not match")
-    }
   } else if u29 & 0x07 == 0x07 {
-    return nil, errors.New("Not support unmarshal for traits ext")
-  } else if u29 & 0x0f == 0x03 || u29 & 0x0f == 0x0b {
-    dyn := false
-    if u29 & 0x08 == 0x08 {
-      dyn = true
+    className, err := readUTF8Vr(d)
+    if err != nil {
+      return nil, err
     }
-    
+
+    traits = &Traits{ClassName: className, Externalizable: true}
+    d.addTraitsRef(traits)
+  } else if u29 & 0x0f == 0x03 || u29 & 0x0f == 0x0b {
     length := u29 >> 4
+    err = d.checkMembers(int(length))
+    if err != nil {
+      return nil, err
+    }
+
     className, err := readUTF8Vr(d)
     if err != nil {
       return nil, err
     }
     
-    obj = NewAMF3Object(className, dyn)
-    ks := make([]string, 0, length)
-    vs := make([]interface{}, 0, length)
+    traits = &Traits{ClassName: className, Dynamic: u29 & 0x08 == 0x08}
+    traits.Members = make([]string, 0, capHint(length))
     for i := uint32(0); i < length; i++ {
       k, err := readUTF8Vr(d)
       if err != nil {
         return nil, err
       }
-      ks = append(ks, k)
-    }
-    obj.keys = ks
-    d.addTraitsRef(obj)
-    for i := uint32(0); i < length; i++ {
-      v, err := d.unmarshal()
-      if err != nil {
-        return nil, err
-      }
-      
-      vs = append(vs, v)
-    }
-    
-    if len(ks) != len(vs) || len(ks) != int(length) {
-      return nil, errors.New("the length of object class members are not match")
-    }
-    
-    for i := uint32(0); i < length; i++ {
-      obj.AddValue(ks[i], vs[i])
+      traits.Members = append(traits.Members, k)
     }
+    d.addTraitsRef(traits)
   } else {
-    return nil, errors.New("Not support object unmarshal format")
+    return nil, formatError("Not support object unmarshal format")
+  }
+
+  if traits.Externalizable {
+    return d.readExternal(traits)
+  }
+
+  obj := traits.NewObject()
+  typed := d.addAliasedObjectRef(obj)
+  for _, k := range traits.Members {
+    v, err := d.unmarshal()
+    if err != nil {
+      return nil, keyPath(err, k)
+    }
+    obj.Values[k] = v
+  }
+  if len(traits.Members) != len(obj.Values) {
+    return nil, formatError("The sealed members of object traits are not unique")
   }
   
-  if obj.Dyn {
+  if obj.Dynamic {
     for {
       k, err := readUTF8Vr(d)
       if err != nil {
@@ -448,10 +826,32 @@ func amf3ObjectDecoder(d *decodeState) (interface{}, error) {
       }
       v, err := d.unmarshal()
       if err != nil {
-        return nil, err
+        return nil, keyPath(err, k)
       }
       obj.AddDynValue(k, v)
+      err = d.checkMembers(len(obj.Values) + len(obj.DynValues))
+      if err != nil {
+        return nil, err
+      }
     }
   }
+  if typed.IsValid() {
+    return typed.Interface(), assignValue(typed.Elem(), obj, d.version)
+  }
   return obj, nil
 }
+
+// addAliasedObjectRef registers the object being decoded. When its class
+// alias is registered, a new value of the Go type takes its place in the
+// reference table and is returned, so that references resolve to it.
+func (d *decodeState) addAliasedObjectRef(obj *AMF3Object) reflect.Value {
+  t, ok := aliasType(obj.ClassName)
+  if !ok {
+    d.addObjectRef(obj)
+    return reflect.Value{}
+  }
+
+  v := reflect.New(t)
+  d.addObjectRef(v.Interface())
+  return v
+}
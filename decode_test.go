@@ -0,0 +1,230 @@
+package goamf
+
+import (
+  "bytes"
+  "errors"
+  "encoding/hex"
+  "reflect"
+  "testing"
+)
+
+func mustHex(t *testing.T, s string) []byte {
+  data, err := hex.DecodeString(s)
+  if err != nil {
+    t.Fatal(err)
+  }
+  return data
+}
+
+func TestDecodeAMF0(t *testing.T) {
+  tests := []struct {
+    data string
+    want interface{}
+  }{
+    {"003ff8000000000000", 1.5},
+    {"0101", true},
+    {"02000568656c6c6f", "hello"},
+    {"05", nil},
+    {"06", Undefined{}},
+    {"0c0000000568656c6c6f", "hello"},
+  }
+
+  for _, test := range tests {
+    v, err := UnmarshalAmf0(mustHex(t, test.data))
+    if err != nil {
+      t.Fatalf("%s: %v", test.data, err)
+    }
+    if !reflect.DeepEqual(v, test.want) {
+      t.Fatalf("%s: got %#v, want %#v", test.data, v, test.want)
+    }
+  }
+
+  v, err := UnmarshalAmf0(mustHex(t, "0300016102000162000009"))
+  if err != nil {
+    t.Fatal(err)
+  }
+  if obj := v.(*AMF0Object); obj.Values["a"] != "b" {
+    t.Fatalf("Got %#v", obj)
+  }
+}
+
+func TestDecodeAMF3(t *testing.T) {
+  tests := []struct {
+    data string
+    want interface{}
+  }{
+    {"00", Undefined{}},
+    {"01", nil},
+    {"02", false},
+    {"03", true},
+    {"0401", int32(1)},
+    {"047f", int32(127)},
+    {"048100", int32(128)},
+    {"04ffffffff", int32(-1)},
+    {"053ff8000000000000", 1.5},
+    {"060b68656c6c6f", "hello"},
+    {"0601", ""},
+  }
+
+  for _, test := range tests {
+    v, err := UnmarshalAmf3(mustHex(t, test.data))
+    if err != nil {
+      t.Fatalf("%s: %v", test.data, err)
+    }
+    if !reflect.DeepEqual(v, test.want) {
+      t.Fatalf("%s: got %#v, want %#v", test.data, v, test.want)
+    }
+  }
+
+  var s string
+  if err := Unmarshal(mustHex(t, "11060b68656c6c6f"), &s); err != nil || s != "hello" {
+    t.Fatalf("Got %q, %v", s, err)
+  }
+}
+
+type testTree struct {
+  Name string `amf:"name"`
+  Parent *testTree `amf:"parent"`
+  Children []*testTree `amf:"children"`
+}
+
+func TestCycles(t *testing.T) {
+  root := &testTree{Name: "root"}
+  child := &testTree{Name: "child", Parent: root}
+  root.Children = []*testTree{child, child}
+
+  var out *testTree
+  roundTrip(t, AMF3, root, &out)
+  if out.Name != "root" || len(out.Children) != 2 || out.Children[0] != out.Children[1] || out.Children[0].Parent != out {
+    t.Fatalf("Lost the shape of the tree: %+v", out)
+  }
+
+  v, err := UnmarshalAmf3(mustMarshal(t, AMF3, root))
+  if err != nil {
+    t.Fatal(err)
+  }
+  if !bytes.Equal(mustMarshal(t, AMF3, v), mustMarshal(t, AMF3, root)) {
+    t.Fatal("The decoded cycle does not encode the same")
+  }
+
+  if _, err := MarshalAmf0(root); err == nil {
+    t.Fatal("AMF0 encoded a cyclic value")
+  }
+}
+
+type testMapTree map[string]testMapTree
+
+type testListTree []testListTree
+
+func TestCyclesIntoMapsAndSlices(t *testing.T) {
+  // A dynamic anonymous object whose "self" member refers to itself.
+  data := mustHex(t, "0a0b010973656c660a000101")
+  var m testMapTree
+  if err := NewDecoder(bytes.NewReader(data), AMF3).Decode(&m); err != nil {
+    t.Fatal(err)
+  }
+  if reflect.ValueOf(m["self"]).Pointer() != reflect.ValueOf(m).Pointer() {
+    t.Fatalf("The map does not refer to itself: %v", m)
+  }
+
+  // An array whose only element is itself.
+  data = mustHex(t, "0903010900")
+  var l testListTree
+  if err := NewDecoder(bytes.NewReader(data), AMF3).Decode(&l); err != nil {
+    t.Fatal(err)
+  }
+  if len(l) != 1 || len(l[0]) != 1 {
+    t.Fatalf("Got %v", l)
+  }
+}
+
+func TestTraitsReuse(t *testing.T) {
+  in := []testAddress{{"a"}, {"b"}, {"c"}}
+  data := mustMarshal(t, AMF3, in)
+  if n := bytes.Count(data, []byte("city")); n != 1 {
+    t.Fatalf("The traits were written %d times: % x", n, data)
+  }
+
+  v, err := UnmarshalAmf3(data)
+  if err != nil {
+    t.Fatal(err)
+  }
+  objs := v.(*AMF3Array).DenseValues
+  if objs[0].(*AMF3Object).Traits != objs[2].(*AMF3Object).Traits {
+    t.Fatal("Decoded objects do not share their traits")
+  }
+
+  var out []testAddress
+  roundTrip(t, AMF3, in, &out)
+  if !reflect.DeepEqual(out, in) {
+    t.Fatalf("Got %v", out)
+  }
+}
+
+func TestDynamicObject(t *testing.T) {
+  obj := NewAMF3Object("", true)
+  obj.AddDynValue("a", 1.0)
+  obj.AddDynValue("b", "x")
+
+  v, err := UnmarshalAmf3(mustMarshal(t, AMF3, obj))
+  if err != nil {
+    t.Fatal(err)
+  }
+  got := v.(*AMF3Object)
+  if !got.Dynamic || got.DynValues["b"] != "x" || !reflect.DeepEqual(got.DynKeys(), []string{"a", "b"}) {
+    t.Fatalf("Got %#v", got)
+  }
+}
+
+func TestDecodeErrors(t *testing.T) {
+  tests := []struct {
+    version uint16
+    data string
+    offset int64
+    path string
+    cause error
+  }{
+    {AMF3, "ff", 1, "", ErrUnsupportedMarker},
+    {AMF3, "0604", 2, "", ErrBadReference},
+    {AMF0, "070001", 1, "", ErrUnsupportedMarker},
+    {AMF3, "0905010401ff", 6, "[1]", ErrUnsupportedMarker},
+    {AMF0, "0300016103000162ff", 9, "a.b", ErrUnsupportedMarker},
+    {AMF3, "0a070358", 4, "", ErrUnknownClass},
+    {AMF3, "0a23010361036104010402", 11, "", ErrMalformed},
+    {AMF0, "030000ff", 4, "", ErrMalformed},
+  }
+
+  for _, test := range tests {
+    _, err := UnmarshalValue(mustHex(t, test.data), test.version)
+    var de *DecodeError
+    if !errors.As(err, &de) {
+      t.Fatalf("%s: got %v, want a DecodeError", test.data, err)
+    }
+    if de.Offset != test.offset || de.Path != test.path || de.Version != test.version || !errors.Is(err, test.cause) {
+      t.Fatalf("%s: got %#v", test.data, de)
+    }
+  }
+
+  _, err := UnmarshalAmf3(mustHex(t, "060b6865"))
+  if err == nil {
+    t.Fatal("A truncated string decoded")
+  }
+}
+
+func TestDecodeTypeErrors(t *testing.T) {
+  var n int8
+  if err := Unmarshal(mustHex(t, "0040c0000000000000"), &n); err == nil {
+    t.Fatalf("8192 fit in an int8: %d", n)
+  }
+
+  var s struct {
+    Name string `amf:"name"`
+  }
+  if err := Unmarshal(mustHex(t, "0300046e616d65003ff000000000000000000009"), &s); err == nil {
+    t.Fatal("A number was assigned to a string")
+  }
+
+  if err := Unmarshal(mustHex(t, "05"), s); err == nil {
+    t.Fatal("A non-pointer was accepted")
+  }
+}
@@ -2,6 +2,7 @@ package goamf
 
 import (
   "io"
+  "sort"
   "reflect"
 )
 
@@ -37,25 +38,35 @@ const (
 )
 
 const (
-  AMF3_UNDEFINED_MARKER = 0x00
-  AMF3_NULL_MARKER      = 0x01
-  AMF3_FALSE_MARKER     = 0x02
-  AMF3_TRUE_MARKER      = 0x03
-  AMF3_INTEGER_MARKER   = 0x04
-  AMF3_DOUBLE_MARKER    = 0x05
-  AMF3_STRING_MARKER    = 0x06
-  AMF3_XMLDOC_MARKER    = 0x07
-  AMF3_DATE_MARKER      = 0x08
-  AMF3_ARRAY_MARKER     = 0x09
-  AMF3_OBJECT_MARKER    = 0x0a
-  AMF3_XML_MARKER       = 0x0b
-  AMF3_BYTEARRAY_MARKER = 0x0c
+  AMF3_UNDEFINED_MARKER     = 0x00
+  AMF3_NULL_MARKER          = 0x01
+  AMF3_FALSE_MARKER         = 0x02
+  AMF3_TRUE_MARKER          = 0x03
+  AMF3_INTEGER_MARKER       = 0x04
+  AMF3_DOUBLE_MARKER        = 0x05
+  AMF3_STRING_MARKER        = 0x06
+  AMF3_XMLDOC_MARKER        = 0x07
+  AMF3_DATE_MARKER          = 0x08
+  AMF3_ARRAY_MARKER         = 0x09
+  AMF3_OBJECT_MARKER        = 0x0a
+  AMF3_XML_MARKER           = 0x0b
+  AMF3_BYTEARRAY_MARKER     = 0x0c
+  AMF3_VECTOR_INT_MARKER    = 0x0d
+  AMF3_VECTOR_UINT_MARKER   = 0x0e
+  AMF3_VECTOR_DOUBLE_MARKER = 0x0f
+  AMF3_VECTOR_OBJECT_MARKER = 0x10
+  AMF3_DICTIONARY_MARKER    = 0x11
 )
 
 const (
   AMF3_UTF8_EMPTY = 0x01
 )
 
+const (
+  AMF3_INTEGER_MAX = 1 << 28 - 1
+  AMF3_INTEGER_MIN = -1 << 28
+)
+
 const (
   UndefinedKind = reflect.UnsafePointer << 1
   
@@ -71,6 +82,11 @@ type Writer interface {
   io.ByteWriter
 }
 
+// Packet is an AMF message packet as used by Flash Remoting. Following
+// Flash Player, every header and body value is AMF0 with reference tables
+// of its own. In AMF3 packets the values switch to AMF3 with the AVM+
+// marker, and a body holding an array of arguments is an AMF0 strict
+// array of such values.
 type Packet struct {
   Version uint16
   Headers []PacketHeader
@@ -90,45 +106,188 @@ type PacketMessage struct {
 
 type Undefined struct{}
 
-type AMF0Object map[string]interface{}
+// XMLDocument is the legacy flash.xml.XMLDocument type.
+type XMLDocument string
+
+// XML is the E4X XML type, which only exists in AMF3.
+type XML string
+
+// AMF0Object is an anonymous AMF0 object. The keys keep the order in which
+// the properties were added, which for decoded objects is the wire order.
+type AMF0Object struct {
+  keys []string
+  Values map[string]interface{}
+}
+
+func NewAMF0Object() *AMF0Object {
+  return &AMF0Object{make([]string, 0), make(map[string]interface{})}
+}
+
+func (obj *AMF0Object) AddValue(k string, v interface{}) {
+  if _, ok := obj.Values[k]; !ok {
+    obj.keys = append(obj.keys, k)
+  }
+  obj.Values[k] = v
+}
+
+// Keys returns the property names in insertion order. Names that were
+// stored into Values directly follow in sorted order.
+func (obj *AMF0Object) Keys() []string {
+  return orderedKeys(obj.keys, obj.Values)
+}
 
 type AMF0TypedObject struct {
   className string
+  keys []string
   values map[string]interface{}
 }
 
 func NewAMF0TypedObject(className string) (*AMF0TypedObject) {
-  return &AMF0TypedObject{className, make(map[string]interface{})}
+  return &AMF0TypedObject{className, make([]string, 0), make(map[string]interface{})}
+}
+
+func (obj *AMF0TypedObject) ClassName() string {
+  return obj.className
 }
 
 func (obj *AMF0TypedObject) AddValue(k string, v interface{}) {
+  if _, ok := obj.values[k]; !ok {
+    obj.keys = append(obj.keys, k)
+  }
   obj.values[k] = v
 }
 
-type AMF3Object struct {
-  ClassName string
-  Dyn bool
+func (obj *AMF0TypedObject) Value(k string) (interface{}, bool) {
+  v, ok := obj.values[k]
+  return v, ok
+}
+
+// Keys returns the property names in insertion order.
+func (obj *AMF0TypedObject) Keys() []string {
+  return orderedKeys(obj.keys, obj.values)
+}
+
+// AMF0ECMAArray is an AMF0 associative array. Count keeps the count
+// declared on the wire, which decoders treat as a hint only, and the keys
+// keep the order in which the properties were added.
+type AMF0ECMAArray struct {
+  Count uint32
   keys []string
   Values map[string]interface{}
+}
+
+func NewAMF0ECMAArray(count uint32) *AMF0ECMAArray {
+  return &AMF0ECMAArray{count, make([]string, 0, count), make(map[string]interface{}, count)}
+}
+
+func (arr *AMF0ECMAArray) AddValue(k string, v interface{}) {
+  if _, ok := arr.Values[k]; !ok {
+    arr.keys = append(arr.keys, k)
+  }
+  arr.Values[k] = v
+}
+
+// Keys returns the property names in insertion order. Names that were
+// stored into Values directly follow in sorted order.
+func (arr *AMF0ECMAArray) Keys() []string {
+  return orderedKeys(arr.keys, arr.Values)
+}
+
+// Traits describe the class of AMF3 objects: the class alias, whether
+// objects take dynamic members, whether they are externalizable and the
+// sealed member names in wire order. Decoded objects of the same traits
+// share one Traits value, so it should be treated as read only.
+type Traits struct {
+  ClassName string
+  Dynamic bool
+  Externalizable bool
+  Members []string
+}
+
+// NewObject returns an empty object of the traits.
+func (t *Traits) NewObject() *AMF3Object {
+  return &AMF3Object{t, make(map[string]interface{}, len(t.Members)), make([]string, 0), make(map[string]interface{})}
+}
+
+func (t *Traits) hasMember(k string) bool {
+  for _, member := range t.Members {
+    if member == k {
+      return true
+    }
+  }
+  return false
+}
+
+// AMF3Object is an AMF3 object. Values holds the sealed members, which
+// are written in the order of the traits, and DynValues the dynamic ones,
+// which keep the order in which they were added.
+type AMF3Object struct {
+  *Traits
+  Values map[string]interface{}
+  dynKeys []string
   DynValues map[string]interface{}
-  isRefObj bool
-  ref uint32
 }
 
 func NewAMF3Object(className string, dyn bool) (*AMF3Object) {
-  return &AMF3Object{className, dyn, make([]string, 0, 1), make(map[string]interface{}), make(map[string]interface{}), false, uint32(0)}
+  return (&Traits{ClassName: className, Dynamic: dyn}).NewObject()
 }
 
+// AddValue sets the sealed member k. A member missing from the traits is
+// added to a copy of them, so objects sharing the traits are not changed.
 func (obj *AMF3Object) AddValue(k string, v interface{}) {
+  if obj.Traits == nil {
+    obj.Traits = new(Traits)
+  }
+  if !obj.hasMember(k) {
+    traits := *obj.Traits
+    traits.Members = append(traits.Members[:len(traits.Members):len(traits.Members)], k)
+    obj.Traits = &traits
+  }
   obj.Values[k] = v
 }
 
 func (obj *AMF3Object) AddDynValue(k string, v interface{}) {
+  if _, ok := obj.DynValues[k]; !ok {
+    obj.dynKeys = append(obj.dynKeys, k)
+  }
   obj.DynValues[k] = v
 }
 
+// DynKeys returns the dynamic member names in insertion order. Names that
+// were stored into DynValues directly follow in sorted order.
+func (obj *AMF3Object) DynKeys() []string {
+  return orderedKeys(obj.dynKeys, obj.DynValues)
+}
+
+// sealedTraits returns the traits obj is written with. Values set without
+// AddValue are written as extra sealed members in sorted order.
+func (obj *AMF3Object) sealedTraits() *Traits {
+  traits := obj.Traits
+  if traits == nil {
+    traits = new(Traits)
+  }
+
+  extra := make([]string, 0)
+  for k := range obj.Values {
+    if !traits.hasMember(k) {
+      extra = append(extra, k)
+    }
+  }
+  if len(extra) == 0 {
+    return traits
+  }
+
+  sort.Strings(extra)
+  t := *traits
+  t.Members = append(append(make([]string, 0, len(traits.Members)+len(extra)), traits.Members...), extra...)
+  return &t
+}
+
+// AMF3Array is an AMF3 array. The associative values keep the order in
+// which they were added.
 type AMF3Array struct {
   DenseValues []interface{}
+  assocKeys []string
   AssocValues map[string]interface{}
 }
 
@@ -137,7 +296,7 @@ func NewAMF3Array(denseCount uint) *AMF3Array {
     denseCount = 1
   }
   
-  return &AMF3Array{make([]interface{}, 0, denseCount), make(map[string]interface{})}
+  return &AMF3Array{make([]interface{}, 0, denseCount), make([]string, 0), make(map[string]interface{})}
 }
 
 func (arr *AMF3Array) AddDenseValue(v interface{}) {
@@ -145,5 +304,109 @@ func (arr *AMF3Array) AddDenseValue(v interface{}) {
 }
 
 func (arr *AMF3Array) AddAssocValue(k string, v interface{}) {
+  if _, ok := arr.AssocValues[k]; !ok {
+    arr.assocKeys = append(arr.assocKeys, k)
+  }
   arr.AssocValues[k] = v
 }
+
+// AssocKeys returns the associative keys in insertion order. Keys that
+// were stored into AssocValues directly follow in sorted order.
+func (arr *AMF3Array) AssocKeys() []string {
+  return orderedKeys(arr.assocKeys, arr.AssocValues)
+}
+
+func orderedKeys(keys []string, values map[string]interface{}) []string {
+  ks := make([]string, 0, len(values))
+  seen := make(map[string]bool, len(keys))
+  for _, k := range keys {
+    if _, ok := values[k]; ok && !seen[k] {
+      seen[k] = true
+      ks = append(ks, k)
+    }
+  }
+
+  if len(ks) == len(values) {
+    return ks
+  }
+
+  extra := make([]string, 0, len(values)-len(ks))
+  for k := range values {
+    if !seen[k] {
+      extra = append(extra, k)
+    }
+  }
+  sort.Strings(extra)
+  return append(ks, extra...)
+}
+
+// Vector is an AMF3 Vector. Values holds an []int32, []uint32, []float64
+// or []interface{}, which are sent as Vector.<int>, Vector.<uint>,
+// Vector.<Number> and Vector.<Object>. TypeName is the element class name
+// of an object vector.
+type Vector struct {
+  Fixed bool
+  TypeName string
+  Values interface{}
+}
+
+func (vec *Vector) marker() (byte, bool) {
+  switch vec.Values.(type) {
+  case []int32:
+    return AMF3_VECTOR_INT_MARKER, true
+  case []uint32:
+    return AMF3_VECTOR_UINT_MARKER, true
+  case []float64:
+    return AMF3_VECTOR_DOUBLE_MARKER, true
+  case []interface{}:
+    return AMF3_VECTOR_OBJECT_MARKER, true
+  }
+  return 0, false
+}
+
+type DictionaryEntry struct {
+  Key, Value interface{}
+}
+
+// Dictionary is the AMF3 Dictionary, whose keys may be any value.
+type Dictionary struct {
+  WeakKeys bool
+  Entries []DictionaryEntry
+}
+
+func NewDictionary(weakKeys bool) *Dictionary {
+  return &Dictionary{weakKeys, make([]DictionaryEntry, 0, 1)}
+}
+
+func (dict *Dictionary) find(k interface{}) int {
+  if k != nil && !reflect.TypeOf(k).Comparable() {
+    return -1
+  }
+
+  for i, entry := range dict.Entries {
+    if entry.Key != nil && !reflect.TypeOf(entry.Key).Comparable() {
+      continue
+    }
+    if entry.Key == k {
+      return i
+    }
+  }
+  return -1
+}
+
+// Set stores v under k, replacing an equal key. Keys that are not
+// comparable, such as maps, are always added.
+func (dict *Dictionary) Set(k, v interface{}) {
+  if i := dict.find(k); i != -1 {
+    dict.Entries[i].Value = v
+    return
+  }
+  dict.Entries = append(dict.Entries, DictionaryEntry{k, v})
+}
+
+func (dict *Dictionary) Get(k interface{}) (interface{}, bool) {
+  if i := dict.find(k); i != -1 {
+    return dict.Entries[i].Value, true
+  }
+  return nil, false
+}
@@ -2,9 +2,15 @@ package goamf
 
 import (
   "io"
+  "fmt"
+  "sort"
+  "math"
+  "time"
+  "strconv"
   "bytes"
   "errors"
   "runtime"
+  "unsafe"
   "reflect"
   "encoding/binary"
 )
@@ -13,9 +19,27 @@ type marshaler interface {
   marshalAmf(e *encodeState) error
 }
 
+// Marshaler is implemented by types that write their own AMF encoding.
+// MarshalAMF gets an Encoder that writes into the value being encoded, so
+// nested values share its reference tables and version. Only the value
+// passed to Encoder.Encode or MarshalValue may write raw bytes with
+// Encoder.Write, which an Unmarshaler passed to Decoder.Decode reads back.
+// Nested in an object, an array or a packet, where the Unmarshaler gets a
+// decoded value, Write fails and MarshalAMF has to use Encode.
+type Marshaler interface {
+  MarshalAMF(enc *Encoder) error
+}
+
+// ClassNamer is implemented by structs that are encoded as typed objects.
+// The returned name is written as the AMF0 typed object class name or the
+// AMF3 traits class name.
+type ClassNamer interface {
+  AMFClassName() string
+}
+
 func marshal(version uint16, v interface{}) ([]byte, error) {
   e := &encodeState{
-    refStore: new(refStore),
+    refStore: newRefStore(),
     version: version,
   }
   err := e.marshal(v)
@@ -27,6 +51,20 @@ func marshal(version uint16, v interface{}) ([]byte, error) {
 
 var Marshal = MarshalAmf0
 
+// MarshalValue encodes v as a single AMF value of the version.
+func MarshalValue(v interface{}, version uint16) ([]byte, error) {
+  if version != AMF0 && version != AMF3 {
+    return nil, ErrUnsupportedVersion
+  }
+  return marshal(version, v)
+}
+
+// MarshalPacket encodes the packet p. Headers and bodies are written the
+// way Flash Player does, see Packet.
+func MarshalPacket(p *Packet) ([]byte, error) {
+  return marshal(p.Version, p)
+}
+
 func MarshalAmf0(v interface{}) ([]byte, error) {
   return marshal(AMF0, v)
 }
@@ -38,7 +76,128 @@ func MarshalAmf3(v interface{}) ([]byte, error) {
 type encodeState struct {
   bytes.Buffer
   *refStore
+  avmPlusRefs *refStore
   version uint16
+  encodeOptions
+  visiting map[interface{}]bool
+  depth int
+}
+
+type encodeOptions struct {
+  ecmaArrays bool
+  strictIntegers bool
+  deterministic bool
+  unknownLengths bool
+}
+
+// An Encoder writes AMF values of one version to an output stream. The
+// reference tables are kept across calls to Encode, matching a Decoder
+// reading the same stream. They grow with every value and keep the
+// objects written alive, so a long-lived stream should call
+// ResetReferences at message boundaries, in step with its Decoder.
+type Encoder struct {
+  w io.Writer
+  e *encodeState
+  nested bool
+}
+
+// NewEncoder returns an encoder writing to w.
+func NewEncoder(w io.Writer, version uint16) *Encoder {
+  return &Encoder{w: w, e: &encodeState{refStore: newRefStore(), version: version}}
+}
+
+// SetMapsAsECMAArray makes the encoder write Go maps as AMF0 ECMA arrays
+// instead of anonymous objects. AMF3 output is not affected.
+func (enc *Encoder) SetMapsAsECMAArray(on bool) {
+  enc.e.ecmaArrays = on
+}
+
+// SetStrictIntegers makes the encoder fail on integers beyond 2^53 in
+// magnitude, which a double can not represent exactly. By default they
+// are rounded to the nearest double.
+func (enc *Encoder) SetStrictIntegers(on bool) {
+  enc.e.strictIntegers = on
+}
+
+// SetDeterministic makes the encoder write Go map entries sorted by key,
+// so that equal values always encode to the same bytes. Objects and arrays
+// of this package are written in insertion order in either mode.
+func (enc *Encoder) SetDeterministic(on bool) {
+  enc.e.deterministic = on
+}
+
+// SetUnknownPacketLengths makes the encoder write the header and body
+// lengths of packets as 0xffffffff, the unknown length, instead of their
+// byte count.
+func (enc *Encoder) SetUnknownPacketLengths(on bool) {
+  enc.e.unknownLengths = on
+}
+
+// Encode writes the AMF encoding of v to the stream.
+func (enc *Encoder) Encode(v interface{}) error {
+  return enc.encode(func() error {
+    return enc.e.marshal(v)
+  })
+}
+
+// EncodeAMF3 writes v as an AMF3 value. An AMF0 encoder writes the AVM+
+// marker first and gives the value its own reference tables.
+func (enc *Encoder) EncodeAMF3(v interface{}) error {
+  return enc.encode(func() error {
+    return enc.e.avmPlus(func() error {
+      return enc.e.marshal(v)
+    })
+  })
+}
+
+// encode runs f and flushes its output to the stream. The Encoder passed
+// to a Marshaler has no stream of its own and writes in place.
+func (enc *Encoder) encode(f func() error) error {
+  if enc.w == nil {
+    return f()
+  }
+  defer enc.e.Reset()
+  enc.e.avmPlusRefs = nil
+
+  err := f()
+  if err != nil {
+    return err
+  }
+
+  _, err = enc.w.Write(enc.e.Bytes())
+  return err
+}
+
+var errNestedWrite = errors.New("The encoder of a nested Marshaler can not write raw bytes")
+
+// Write writes raw bytes to the stream. It fails for the Encoder of a
+// nested Marshaler, see Marshaler.
+func (enc *Encoder) Write(p []byte) (int, error) {
+  if enc.nested {
+    return 0, errNestedWrite
+  }
+  if enc.w == nil {
+    return enc.e.Write(p)
+  }
+  return enc.w.Write(p)
+}
+
+func (enc *Encoder) WriteByte(c byte) error {
+  _, err := enc.Write([]byte{c})
+  return err
+}
+
+// Version returns the AMF version values are currently written in. It is
+// AMF3 inside a value that follows the AVM+ marker.
+func (enc *Encoder) Version() uint16 {
+  return enc.e.version
+}
+
+// ResetReferences clears the string, object and traits reference tables.
+// The decoder of the stream has to reset its tables at the same point.
+func (enc *Encoder) ResetReferences() {
+  enc.e.refStore = newRefStore()
+  enc.e.avmPlusRefs = nil
 }
 
 func (e *encodeState) marshal(v interface{}) (err error) {
@@ -47,10 +206,11 @@ func (e *encodeState) marshal(v interface{}) (err error) {
       if _, ok := r.(runtime.Error); ok {
         panic(r)
       }
-      if s, ok := r.(string); ok {
-        panic(s)
+      if e, ok := r.(error); ok {
+        err = e
+      } else {
+        panic(r)
       }
-      err = r.(error)
     }
   }()
   
@@ -58,26 +218,159 @@ func (e *encodeState) marshal(v interface{}) (err error) {
   return nil
 }
 
-func (e *encodeState) marshalNew(v interface{}) (e2 *encodeState, err error) {
-  e2 = &encodeState{
-    refStore: new(refStore),
-    version: e.version,
+// marshalPacketValue encodes a packet header or body value with its own
+// reference tables. Values are AMF0, as Flash Player writes them. In AMF3
+// packets they switch to AMF3 with the AVM+ marker, except that an array
+// of arguments stays an AMF0 strict array of AVM+ values.
+func (e *encodeState) marshalPacketValue(v interface{}, version uint16) (*encodeState, error) {
+  // Packet values are decoded before they are assigned, so they count as
+  // nested for Marshalers.
+  e2 := &encodeState{
+    refStore: newRefStore(),
+    version: AMF0,
+    encodeOptions: e.encodeOptions,
+    depth: 1,
+  }
+  if version == AMF3 {
+    v = avmPlusArgs(v)
   }
-  err = e2.marshal(v)
+
+  err := e2.marshal(v)
   if err != nil {
     return nil, err
   }
-  
-  return
+  return e2, nil
+}
+
+// avmPlusValue is written as an AMF3 value behind the AVM+ marker.
+type avmPlusValue struct {
+  v interface{}
+}
+
+func (v avmPlusValue) marshalAmf(e *encodeState) error {
+  if v.v == nil {
+    return e.marshal(nil)
+  }
+
+  return e.avmPlus(func() error {
+    return e.marshal(v.v)
+  })
+}
+
+func avmPlusArgs(v interface{}) interface{} {
+  rv := reflect.ValueOf(v)
+  switch rv.Kind() {
+  case reflect.Slice:
+    if rv.IsNil() || rv.Type().Elem().Kind() == reflect.Uint8 {
+      return avmPlusValue{v}
+    }
+  case reflect.Array:
+  default:
+    return avmPlusValue{v}
+  }
+
+  args := make([]interface{}, rv.Len())
+  for i := range args {
+    args[i] = avmPlusValue{rv.Index(i).Interface()}
+  }
+  return args
+}
+
+// avmPlus runs f in AMF3 mode. In AMF0 it first writes the AVM+ marker.
+// Like the decoder, the AMF3 values of one top-level value or packet body
+// share their reference tables, which are apart from the AMF0 ones.
+func (e *encodeState) avmPlus(f func() error) error {
+  if e.version == AMF3 {
+    return f()
+  }
+
+  err := e.WriteByte(byte(AMF0_ACMPLUS_OBJECT_MARKER))
+  if err != nil {
+    return err
+  }
+
+  if e.avmPlusRefs == nil {
+    e.avmPlusRefs = newRefStore()
+  }
+  version, refS := e.version, e.refStore
+  e.version, e.refStore = AMF3, e.avmPlusRefs
+  defer func() {
+    e.version, e.refStore = version, refS
+  }()
+  return f()
 }
 
 func (e *encodeState) reflectValue(v reflect.Value) {
+  e.depth++
+  defer func() {
+    e.depth--
+  }()
+
+  if e.version == AMF0 {
+    if key := identity(v); key != nil {
+      if e.visiting[key] {
+        panic(errors.New("AMF0 can not encode cyclic value of type " + v.Type().String()))
+      }
+
+      if e.visiting == nil {
+        e.visiting = make(map[interface{}]bool)
+      }
+      e.visiting[key] = true
+      defer delete(e.visiting, key)
+    }
+  }
+
   err := valueEncoder(e.version, v)(e, v)
   if err != nil {
     panic(err)
   }
 }
 
+// refKey holds an unsafe.Pointer rather than an address, so that the
+// objects in a reference table stay alive for as long as the table. Their
+// addresses can not be reused by later values of a stream.
+type refKey struct {
+  t reflect.Type
+  p unsafe.Pointer
+  n int
+}
+
+// identity returns a comparable key for the object a pointer, map or slice
+// refers to, or nil for values that have no identity.
+func identity(v reflect.Value) interface{} {
+  switch v.Kind() {
+  case reflect.Ptr, reflect.Map:
+    if !v.IsNil() {
+      return refKey{v.Type(), unsafe.Pointer(v.Pointer()), 0}
+    }
+  case reflect.Slice:
+    if !v.IsNil() {
+      return refKey{v.Type(), unsafe.Pointer(v.Pointer()), v.Len()}
+    }
+  }
+  return nil
+}
+
+// writeObjectRef writes marker and a reference when the object identified
+// by key was already written. Otherwise it registers the object before its
+// members are written, which keeps the table in step with the decoder and
+// lets cyclic values refer back to it. Objects without identity pass a nil
+// key and only take a slot in the table.
+func writeObjectRef(e *encodeState, marker byte, key interface{}) (bool, error) {
+  if key != nil {
+    if index, ok := e.findObjectRef(key); ok {
+      err := e.WriteByte(marker)
+      if err != nil {
+        return true, err
+      }
+      return true, writeU29Ref(e, index)
+    }
+  }
+
+  e.addObjectRef(key)
+  return false, nil
+}
+
 type encoderFunc func(e *encodeState, v reflect.Value) (err error)
 
 func valueEncoder(version uint16, v reflect.Value) encoderFunc {
@@ -102,11 +395,34 @@ func invalidValueEncoder(e *encodeState, v reflect.Value) error {
 }
 
 var marshalerType = reflect.TypeOf(new(marshaler)).Elem()
+var amfMarshalerType = reflect.TypeOf(new(Marshaler)).Elem()
+var timeType = reflect.TypeOf(time.Time{})
 
 func typeEncoder(t reflect.Type) encoderFunc {
-  if t.Implements(marshalerType) {
+  if t.Implements(marshalerType) || (t.Kind() != reflect.Ptr && reflect.PtrTo(t).Implements(marshalerType)) {
     return marshalerEncoder
   }
+
+  if t.Implements(amfMarshalerType) || (t.Kind() != reflect.Ptr && reflect.PtrTo(t).Implements(amfMarshalerType)) {
+    return amfMarshalerEncoder
+  }
+
+  if t.Implements(externalizableType) || (t.Kind() != reflect.Ptr && reflect.PtrTo(t).Implements(externalizableType)) {
+    return externalizableEncoder
+  }
+
+  if t == timeType {
+    return timeEncoder
+  }
+
+  if t.Kind() == reflect.Slice {
+    switch t.Elem().Kind() {
+    case reflect.Uint8:
+      return bytesEncoder
+    case reflect.Int32, reflect.Uint32, reflect.Float64:
+      return vectorEncoder
+    }
+  }
   
   switch t.Kind() {
   case reflect.String:
@@ -122,6 +438,11 @@ func typeEncoder(t reflect.Type) encoderFunc {
   case reflect.Array, reflect.Slice:
     return arrayEncoder
   case reflect.Map:
+    return mapEncoder
+  case reflect.Struct:
+    return structEncoder
+  case reflect.Ptr, reflect.Interface:
+    return indirectEncoder
   }
   return invalidValueEncoder
 }
@@ -130,17 +451,71 @@ func marshalerEncoder(e *encodeState, v reflect.Value) error {
   if v.Kind() == reflect.Ptr && v.IsNil() {
     return errors.New("The marshaler value shouldn't be nil pointer")
   }
+
+  if v.Kind() != reflect.Ptr && !v.Type().Implements(marshalerType) {
+    p := reflect.New(v.Type())
+    p.Elem().Set(v)
+    v = p
+  }
   
   m := v.Interface().(marshaler)
   return m.marshalAmf(e)
 }
 
-// AMF0_NUMBER_MARKER, AMF3_INTEGER_MARKER
+func amfMarshalerEncoder(e *encodeState, v reflect.Value) error {
+  switch v.Kind() {
+  case reflect.Ptr, reflect.Interface:
+    if v.IsNil() {
+      return nilValueEncoder(e, v)
+    }
+  default:
+    if !v.Type().Implements(amfMarshalerType) {
+      p := reflect.New(v.Type())
+      p.Elem().Set(v)
+      v = p
+    }
+  }
+
+  return v.Interface().(Marshaler).MarshalAMF(&Encoder{e: e, nested: e.depth > 1})
+}
+
+// AMF0_NUMBER_MARKER, AMF3_INTEGER_MARKER, AMF3_DOUBLE_MARKER
 func numberEncoder(e *encodeState, v reflect.Value) (err error) {
+  switch v.Kind() {
+  case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+    return writeNumberInt(e, v.Int())
+  case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+    n := v.Uint()
+    if n <= math.MaxInt64 {
+      return writeNumberInt(e, int64(n))
+    }
+    if e.strictIntegers {
+      return errors.New("The integer " + strconv.FormatUint(n, 10) + " can not be represented exactly as a double")
+    }
+    return writeNumber(e, float64(n))
+  }
+  return writeNumber(e, v.Float())
+}
+
+// writeNumberInt writes n as an AMF3 integer when it fits in 29 bits and
+// as a double otherwise.
+func writeNumberInt(e *encodeState, n int64) error {
+  if e.version != AMF0 && n >= AMF3_INTEGER_MIN && n <= AMF3_INTEGER_MAX {
+    _, err := writeInteger(e, uint32(n) & 0x1fffffff)
+    return err
+  }
+
+  if e.strictIntegers && (n > 1 << 53 || n < -1 << 53) {
+    return errors.New("The integer " + strconv.FormatInt(n, 10) + " can not be represented exactly as a double")
+  }
+  return writeNumber(e, float64(n))
+}
+
+func writeNumber(e *encodeState, f float64) (err error) {
   if e.version == AMF0 {
-    _, err = writeDouble(e, v.Float())
+    _, err = writeDouble(e, f)
   } else {
-    _, err = writeInteger(e, uint32(v.Uint()))
+    err = writeAMF3Double(e, f)
   }
   return
 }
@@ -170,12 +545,297 @@ func stringEncoder(e *encodeState, v reflect.Value) (err error) {
   return err
 }
 
-// AMF0_STRICT_ARRAY_MARKER
+// AMF0_DATE_MARKER, AMF3_DATE_MARKER
+func timeEncoder(e *encodeState, v reflect.Value) error {
+  t := v.Interface().(time.Time)
+  if e.version == AMF0 {
+    return writeDate(e, t)
+  }
+
+  ref, err := writeObjectRef(e, AMF3_DATE_MARKER, t)
+  if ref || err != nil {
+    return err
+  }
+  return writeAMF3Date(e, t)
+}
+
+// AMF3_BYTEARRAY_MARKER
+func bytesEncoder(e *encodeState, v reflect.Value) error {
+  if v.IsNil() {
+    return nilValueEncoder(e, v)
+  }
+
+  return NewByteArray(v.Bytes()).marshalAmf(e)
+}
+
+// AMF3_VECTOR_INT_MARKER, AMF3_VECTOR_UINT_MARKER, AMF3_VECTOR_DOUBLE_MARKER
+func vectorEncoder(e *encodeState, v reflect.Value) error {
+  if e.version == AMF0 || v.IsNil() {
+    return arrayEncoder(e, v)
+  }
+
+  // Element types may be named, so the values are copied one by one.
+  var values interface{}
+  switch v.Type().Elem().Kind() {
+  case reflect.Int32:
+    ints := make([]int32, v.Len())
+    for i := range ints {
+      ints[i] = int32(v.Index(i).Int())
+    }
+    values = ints
+  case reflect.Uint32:
+    uints := make([]uint32, v.Len())
+    for i := range uints {
+      uints[i] = uint32(v.Index(i).Uint())
+    }
+    values = uints
+  default:
+    floats := make([]float64, v.Len())
+    for i := range floats {
+      floats[i] = v.Index(i).Float()
+    }
+    values = floats
+  }
+  return writeVector(e, &Vector{Values: values}, identity(v))
+}
+
+// AMF3_DICTIONARY_MARKER
+func dictionaryEncoder(e *encodeState, v reflect.Value) error {
+  ref, err := writeObjectRef(e, AMF3_DICTIONARY_MARKER, identity(v))
+  if ref || err != nil {
+    return err
+  }
+
+  err = writeDictionaryHeader(e, v.Len(), false)
+  if err != nil {
+    return err
+  }
+
+  for _, k := range e.mapKeys(v) {
+    e.reflectValue(k)
+    e.reflectValue(v.MapIndex(k))
+  }
+  return nil
+}
+
+// mapKeys returns the keys of the map v, sorted in deterministic mode.
+func (e *encodeState) mapKeys(v reflect.Value) []reflect.Value {
+  keys := v.MapKeys()
+  if e.deterministic {
+    sort.Slice(keys, func(i, j int) bool {
+      return lessKey(keys[i], keys[j])
+    })
+  }
+  return keys
+}
+
+// lessKey orders map keys by kind, then by value. Keys that have no
+// natural order are compared by their printed form.
+func lessKey(a, b reflect.Value) bool {
+  if a.Kind() == reflect.Interface {
+    a = a.Elem()
+  }
+  if b.Kind() == reflect.Interface {
+    b = b.Elem()
+  }
+  if !a.IsValid() || !b.IsValid() {
+    return !a.IsValid() && b.IsValid()
+  }
+
+  ra, rb := keyRank(a.Kind()), keyRank(b.Kind())
+  if ra != rb {
+    return ra < rb
+  }
+
+  switch ra {
+  case 0:
+    return !a.Bool() && b.Bool()
+  case 1:
+    return a.Int() < b.Int()
+  case 2:
+    return a.Uint() < b.Uint()
+  case 3:
+    return a.Float() < b.Float()
+  case 4:
+    return a.String() < b.String()
+  }
+  return fmt.Sprint(a.Interface()) < fmt.Sprint(b.Interface())
+}
+
+func keyRank(k reflect.Kind) int {
+  switch k {
+  case reflect.Bool:
+    return 0
+  case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+    return 1
+  case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+    return 2
+  case reflect.Float32, reflect.Float64:
+    return 3
+  case reflect.String:
+    return 4
+  }
+  return 5
+}
+
+// AMF0_STRICT_ARRAY_MARKER, AMF3_ARRAY_MARKER
 func arrayEncoder(e *encodeState, v reflect.Value) (err error) {
+  if v.Kind() == reflect.Slice && v.IsNil() {
+    return nilValueEncoder(e, v)
+  }
+
   if e.version == AMF0 {
-    err = writeStrictArray(e, v.Interface().([]interface{}))
+    return writeStrictArray(e, v)
   }
-  return err
+
+  ref, err := writeObjectRef(e, AMF3_ARRAY_MARKER, identity(v))
+  if ref || err != nil {
+    return err
+  }
+  return writeDenseArray(e, v)
+}
+
+func indirectEncoder(e *encodeState, v reflect.Value) error {
+  if v.IsNil() {
+    return nilValueEncoder(e, v)
+  }
+
+  if v.Kind() == reflect.Ptr && v.Elem().Kind() == reflect.Struct && v.Elem().Type() != timeType {
+    return encodeStruct(e, v.Elem(), identity(v))
+  }
+
+  e.reflectValue(v.Elem())
+  return nil
+}
+
+// AMF0_OBJECT_MARKER, AMF3_OBJECT_MARKER
+func mapEncoder(e *encodeState, v reflect.Value) (err error) {
+  if v.IsNil() {
+    return nilValueEncoder(e, v)
+  }
+
+  if v.Type().Key().Kind() != reflect.String {
+    if e.version != AMF0 {
+      return dictionaryEncoder(e, v)
+    }
+    return errors.New("The key of encoded map must be string")
+  }
+  if v.MapIndex(reflect.Zero(v.Type().Key())).IsValid() {
+    return errEmptyName
+  }
+
+  if e.version == AMF0 && e.ecmaArrays {
+    keys := make([]string, 0, v.Len())
+    for _, k := range e.mapKeys(v) {
+      keys = append(keys, k.String())
+    }
+    return writeECMAArray(e, keys, func(k string) reflect.Value {
+      return v.MapIndex(reflect.ValueOf(k).Convert(v.Type().Key()))
+    })
+  }
+
+  if e.version == AMF0 {
+    err = e.WriteByte(AMF0_OBJECT_MARKER)
+  } else {
+    var ref bool
+    ref, err = writeObjectRef(e, AMF3_OBJECT_MARKER, identity(v))
+    if ref || err != nil {
+      return
+    }
+    err = writeObjectTraits(e, &Traits{Dynamic: true})
+  }
+  if err != nil {
+    return
+  }
+
+  for _, k := range e.mapKeys(v) {
+    if e.version == AMF0 {
+      _, err = writeUTF8(e, k.String())
+    } else {
+      _, err = writeUTF8Vr(e, k.String())
+    }
+    if err != nil {
+      return
+    }
+
+    e.reflectValue(v.MapIndex(k))
+  }
+
+  if e.version == AMF0 {
+    return writeObjectEnd(e)
+  }
+  return writeAMF3EmptyUTF8(e)
+}
+
+// AMF0_OBJECT_MARKER, AMF0_TYPED_OBJECT_MARKER, AMF3_OBJECT_MARKER
+func structEncoder(e *encodeState, v reflect.Value) error {
+  return encodeStruct(e, v, nil)
+}
+
+// encodeStruct writes the struct v. The key identifies the pointer v was
+// reached through, so that AMF3 can refer back to it.
+func encodeStruct(e *encodeState, v reflect.Value, key interface{}) (err error) {
+  className, _ := typeAlias(v.Type())
+  if v.CanInterface() {
+    if namer, ok := v.Interface().(ClassNamer); ok {
+      className = namer.AMFClassName()
+    } else if v.CanAddr() {
+      if namer, ok := v.Addr().Interface().(ClassNamer); ok {
+        className = namer.AMFClassName()
+      }
+    }
+  }
+
+  fields := cachedTypeFields(v.Type())
+  names := make([]string, 0, len(fields))
+  values := make([]reflect.Value, 0, len(fields))
+  for _, f := range fields {
+    fv, ok := fieldValue(v, f.index)
+    if !ok || (f.omitEmpty && isEmptyValue(fv)) {
+      continue
+    }
+    names = append(names, f.name)
+    values = append(values, fv)
+  }
+
+  if e.version != AMF0 {
+    ref, err := writeObjectRef(e, AMF3_OBJECT_MARKER, key)
+    if ref || err != nil {
+      return err
+    }
+
+    err = writeObjectTraits(e, &Traits{ClassName: className, Members: names})
+    if err != nil {
+      return err
+    }
+
+    for _, fv := range values {
+      e.reflectValue(fv)
+    }
+    return nil
+  }
+
+  if className == "" {
+    err = e.WriteByte(AMF0_OBJECT_MARKER)
+  } else {
+    err = e.WriteByte(AMF0_TYPED_OBJECT_MARKER)
+    if err == nil {
+      _, err = writeUTF8(e, className)
+    }
+  }
+  if err != nil {
+    return
+  }
+
+  for i, fv := range values {
+    _, err = writeUTF8(e, names[i])
+    if err != nil {
+      return
+    }
+
+    e.reflectValue(fv)
+  }
+  return writeObjectEnd(e)
 }
 
 func (p *Packet) marshalAmf(e *encodeState) (err error) {
@@ -200,12 +860,12 @@ func (p *Packet) marshalAmf(e *encodeState) (err error) {
     }
     
     var e2 *encodeState
-    e2, err = e.marshalNew(header.Value)
+    e2, err = e.marshalPacketValue(header.Value, p.Version)
     if err != nil {
       return
     }
     
-    err = writeU32(e, uint32(e2.Len()))
+    err = writeU32(e, e.packetValueLength(e2))
     if err != nil {
       return
     }
@@ -232,13 +892,12 @@ func (p *Packet) marshalAmf(e *encodeState) (err error) {
     }
     
     var e2 *encodeState
-    e2, err = e.marshalNew(message.Value)
+    e2, err = e.marshalPacketValue(message.Value, p.Version)
     if err != nil {
       return
     }
     
-    length := uint32(e2.Len())
-    err = binary.Write(e, binary.BigEndian, &length)
+    err = writeU32(e, e.packetValueLength(e2))
     if err != nil {
       return
     }
@@ -251,31 +910,29 @@ func (p *Packet) marshalAmf(e *encodeState) (err error) {
   return
 }
 
-// AMF0_OBJECT_MARKER
-func (obj AMF0Object) marshalAmf(e *encodeState) error {
-  err := e.WriteByte(AMF0_OBJECT_MARKER)
-  if err != nil {
-    return err
+func (e *encodeState) packetValueLength(e2 *encodeState) uint32 {
+  if e.unknownLengths {
+    return 0xffffffff
   }
-  
-  for k, v := range obj {
-    _, err = writeUTF8(e, k)
-    if err != nil {
-      return err
-    }
-    
-    err = e.marshal(v)
-    if err != nil {
+  return uint32(e2.Len())
+}
+
+// AMF0_OBJECT_MARKER, AMF3_OBJECT_MARKER
+func (obj *AMF0Object) marshalAmf(e *encodeState) error {
+  if e.version != AMF0 {
+    ref, err := writeObjectRef(e, AMF3_OBJECT_MARKER, obj)
+    if ref || err != nil {
       return err
     }
+    return writeAMF3Object(e, &Traits{Dynamic: true}, nil, obj.Keys(), obj.Values)
   }
-  
-  err = writeAMF0EmptyUTF8(e)
+
+  err := e.WriteByte(AMF0_OBJECT_MARKER)
   if err != nil {
     return err
   }
   
-  err = e.WriteByte(AMF0_OBJECT_END_MARKER)
+  err = writeObjectProperties(e, obj.Keys(), obj.Values)
   if err != nil {
     return err
   }
@@ -284,139 +941,244 @@ func (obj AMF0Object) marshalAmf(e *encodeState) error {
   return nil
 }
 
-// AMF0_UNDEFINED_MARKER, AMF3_UNDEFINED_MARKER
-func (undef Undefined) marshalAmf(e *encodeState) error {
-  marker := byte(AMF0_UNDEFINED_MARKER)
+// AMF0_TYPED_OBJECT_MARKER, AMF3_OBJECT_MARKER
+func (obj *AMF0TypedObject) marshalAmf(e *encodeState) error {
+  keys := obj.Keys()
   if e.version != AMF0 {
-    marker = byte(AMF3_UNDEFINED_MARKER)
+    ref, err := writeObjectRef(e, AMF3_OBJECT_MARKER, obj)
+    if ref || err != nil {
+      return err
+    }
+    return writeAMF3Object(e, &Traits{ClassName: obj.className, Members: keys}, obj.values, nil, nil)
   }
-  
-  return e.WriteByte(marker)
-}
 
-// AMF3_ARRAY_MARKER
-func (arr AMF3Array) marshalAmf(e *encodeState) (err error) {
-  err = e.WriteByte(byte(AMF3_ARRAY_MARKER))
+  err := e.WriteByte(AMF0_TYPED_OBJECT_MARKER)
   if err != nil {
-    return
-  }
-  
-  if index, hasRef := e.findObjectRef(&arr); hasRef {
-    return writeU29Ref(e, index)
+    return err
   }
-  
-  length := uint32(0)
-  if arr.DenseValues != nil && len(arr.DenseValues) != 0 {
-    length = uint32(len(arr.DenseValues))
+
+  _, err = writeUTF8(e, obj.className)
+  if err != nil {
+    return err
   }
-  
-  u29 := length << 1 | 0x01
-  _, err = writeU29(e, u29)
+
+  err = writeObjectProperties(e, keys, obj.values)
   if err != nil {
-    return
+    return err
   }
-  
-  for k, v := range arr.AssocValues {
-    err = writeAssocValue(e, k, v);
+
+  e.addObjectRef(obj)
+  return nil
+}
+
+// AMF0_ECMA_ARRAY_MARKER, AMF3_ARRAY_MARKER
+func (arr *AMF0ECMAArray) marshalAmf(e *encodeState) error {
+  if e.version != AMF0 {
+    ref, err := writeObjectRef(e, AMF3_ARRAY_MARKER, arr)
+    if ref || err != nil {
+      return err
+    }
+
+    err = e.WriteByte(byte(AMF3_ARRAY_MARKER))
     if err != nil {
-      return
+      return err
     }
-  }
-  
-  err = writeAMF3EmptyUTF8(e)
-  if err != nil {
-    return
-  }
-  
-  for _, v := range arr.DenseValues {
-    err = e.marshal(v)
+
+    _, err = writeU29(e, 0x01)
     if err != nil {
-      return
+      return err
     }
+
+    for _, k := range arr.Keys() {
+      err = writeAssocValue(e, k, arr.Values[k])
+      if err != nil {
+        return err
+      }
+    }
+    return writeAMF3EmptyUTF8(e)
   }
-  
-  if err != nil {
-    e.objectRef = append(e.objectRef, arr)
-  }
-  return
+
+  return writeECMAArray(e, arr.Keys(), func(k string) reflect.Value {
+    return reflect.ValueOf(arr.Values[k])
+  })
 }
 
-// AMF3_OBJECT_MARKER
-func (obj *AMF3Object) marshalAmf(e *encodeState) (err error) {
-  version := e.version
-  if e.version != AMF3 {
-    err = e.WriteByte(byte(AMF0_ACMPLUS_OBJECT_MARKER))
+// AMF0_XML_DOCUMENT_MARKER, AMF3_XMLDOC_MARKER
+func (doc XMLDocument) marshalAmf(e *encodeState) error {
+  if e.version == AMF0 {
+    err := e.WriteByte(AMF0_XML_DOCUMENT_MARKER)
     if err != nil {
-      return
+      return err
     }
-    e.version = AMF3
+
+    _, err = writeLongUTF8(e, string(doc))
+    return err
   }
-  
-  err = e.WriteByte(byte(AMF3_OBJECT_MARKER))
-  if err != nil {
-    return
+
+  return writeXML(e, AMF3_XMLDOC_MARKER, string(doc), doc)
+}
+
+// AMF3_XML_MARKER
+func (x XML) marshalAmf(e *encodeState) error {
+  return e.avmPlus(func() error {
+    return writeXML(e, AMF3_XML_MARKER, string(x), x)
+  })
+}
+
+// AMF0_UNDEFINED_MARKER, AMF3_UNDEFINED_MARKER
+func (undef Undefined) marshalAmf(e *encodeState) error {
+  marker := byte(AMF0_UNDEFINED_MARKER)
+  if e.version != AMF0 {
+    marker = byte(AMF3_UNDEFINED_MARKER)
   }
   
-  tmpValues := make([]interface{}, 0)
-  if obj.isRefObj {
-    err := writeTraitsRef(e, obj.ref)
-    if err != nil {
+  return e.WriteByte(marker)
+}
+
+// AMF3_ARRAY_MARKER
+func (arr *AMF3Array) marshalAmf(e *encodeState) error {
+  return e.avmPlus(func() error {
+    ref, err := writeObjectRef(e, AMF3_ARRAY_MARKER, arr)
+    if ref || err != nil {
       return err
     }
-    
-    for _, key := range obj.keys {
-      tmpValues = append(tmpValues, obj.Values[key])
-    }
-  } else {
-    valueLen := uint32(len(obj.Values)) << 4 | 0x03
-    if obj.Dyn {
-      valueLen = valueLen | 0x08
+
+    err = e.WriteByte(byte(AMF3_ARRAY_MARKER))
+    if err != nil {
+      return err
     }
-    _, err = writeU29(e, valueLen)
+
+    u29 := uint32(len(arr.DenseValues)) << 1 | 0x01
+    _, err = writeU29(e, u29)
     if err != nil {
-      return
+      return err
     }
-    
-    _, err = writeUTF8Vr(e, obj.ClassName)
+
+    for _, k := range arr.AssocKeys() {
+      err = writeAssocValue(e, k, arr.AssocValues[k])
+      if err != nil {
+        return err
+      }
+    }
+
+    err = writeAMF3EmptyUTF8(e)
     if err != nil {
-      return
+      return err
     }
 
-    for k, v := range obj.Values {
-      _, err = writeUTF8Vr(e, k)
+    for _, v := range arr.DenseValues {
+      err = e.marshal(v)
       if err != nil {
         return err
       }
-      tmpValues = append(tmpValues, v)
     }
-  }
-    
-  for _, v := range tmpValues {
-    err = e.marshal(v)
+    return nil
+  })
+}
+
+// AMF3_BYTEARRAY_MARKER
+func (ba *ByteArray) marshalAmf(e *encodeState) error {
+  return e.avmPlus(func() error {
+    ref, err := writeObjectRef(e, AMF3_BYTEARRAY_MARKER, ba)
+    if ref || err != nil {
+      return err
+    }
+
+    err = e.WriteByte(byte(AMF3_BYTEARRAY_MARKER))
     if err != nil {
       return err
     }
-  }
-  
-  if obj.Dyn {
-    for k, v := range obj.DynValues {
-      _, err = writeUTF8Vr(e, k)
+
+    _, err = writeU29(e, uint32(len(ba.buf)) << 1 | 0x01)
+    if err != nil {
+      return err
+    }
+
+    _, err = e.Write(ba.buf)
+    return err
+  })
+}
+
+// AMF3_VECTOR_INT_MARKER, AMF3_VECTOR_UINT_MARKER, AMF3_VECTOR_DOUBLE_MARKER,
+// AMF3_VECTOR_OBJECT_MARKER
+func (vec *Vector) marshalAmf(e *encodeState) error {
+  return e.avmPlus(func() error {
+    return writeVector(e, vec, vec)
+  })
+}
+
+// AMF3_DICTIONARY_MARKER
+func (dict *Dictionary) marshalAmf(e *encodeState) error {
+  return e.avmPlus(func() error {
+    ref, err := writeObjectRef(e, AMF3_DICTIONARY_MARKER, dict)
+    if ref || err != nil {
+      return err
+    }
+
+    err = writeDictionaryHeader(e, len(dict.Entries), dict.WeakKeys)
+    if err != nil {
+      return err
+    }
+
+    for _, entry := range dict.Entries {
+      err = e.marshal(entry.Key)
       if err != nil {
         return err
       }
-      err = e.marshal(v)
+
+      err = e.marshal(entry.Value)
       if err != nil {
         return err
       }
     }
-    
-    err = writeAMF3EmptyUTF8(e)
+    return nil
+  })
+}
+
+// AMF3_OBJECT_MARKER
+func (obj *AMF3Object) marshalAmf(e *encodeState) error {
+  return e.avmPlus(func() error {
+    return obj.marshalAmf3(e)
+  })
+}
+
+func (obj *AMF3Object) marshalAmf3(e *encodeState) error {
+  if ref, err := writeObjectRef(e, AMF3_OBJECT_MARKER, obj); ref || err != nil {
+    return err
+  }
+
+  traits := obj.sealedTraits()
+  if traits.Externalizable {
+    return errors.New("Externalizable class " + traits.ClassName + " can only be encoded from its Go type")
+  }
+  return writeAMF3Object(e, traits, obj.Values, obj.DynKeys(), obj.DynValues)
+}
+
+// writeAMF3Object writes the traits, the sealed values in the order of the
+// traits members and, for dynamic traits, the dynamic values in the order
+// of dynKeys. The object reference is left to the caller.
+func writeAMF3Object(e *encodeState, traits *Traits, values map[string]interface{}, dynKeys []string, dynValues map[string]interface{}) error {
+  err := writeObjectTraits(e, traits)
+  if err != nil {
+    return err
+  }
+
+  for _, k := range traits.Members {
+    err = e.marshal(values[k])
     if err != nil {
-      return
+      return err
     }
   }
   
-  e.addTraitsRef(obj)
-  e.version = version
-  return
+  if !traits.Dynamic {
+    return nil
+  }
+
+  for _, k := range dynKeys {
+    err = writeAssocValue(e, k, dynValues[k])
+    if err != nil {
+      return err
+    }
+  }
+  return writeAMF3EmptyUTF8(e)
 }
@@ -0,0 +1,527 @@
+package goamf
+
+import (
+  "bytes"
+  "math"
+  "reflect"
+  "runtime"
+  "strconv"
+  "testing"
+  "time"
+)
+
+var versions = []uint16{AMF0, AMF3}
+
+// roundTrip encodes in and decodes it into out with the same version.
+func roundTrip(t *testing.T, version uint16, in, out interface{}) []byte {
+  data, err := MarshalValue(in, version)
+  if err != nil {
+    t.Fatalf("AMF%d encode %#v: %v", version, in, err)
+  }
+
+  err = NewDecoder(bytes.NewReader(data), version).Decode(out)
+  if err != nil {
+    t.Fatalf("AMF%d decode % x: %v", version, data, err)
+  }
+  return data
+}
+
+type testAddress struct {
+  City string `amf:"city"`
+}
+
+type testBase struct {
+  Id float64 `amf:"id"`
+}
+
+type testPerson struct {
+  testBase
+  Name string `amf:"name"`
+  Note string `amf:"note,omitempty"`
+  Age int
+  Tags []string
+  Addr *testAddress `amf:"addr"`
+  Scores map[string]float64
+  Skip string `amf:"-"`
+}
+
+func TestStructRoundTrip(t *testing.T) {
+  in := testPerson{testBase{3}, "bob", "", 42, []string{"a", "b"}, &testAddress{"x"}, map[string]float64{"k": 1.5}, "no"}
+  for _, version := range versions {
+    var out testPerson
+    data := roundTrip(t, version, &in, &out)
+
+    in.Skip = ""
+    if !reflect.DeepEqual(out, in) {
+      t.Fatalf("AMF%d got %+v, want %+v", version, out, in)
+    }
+    if bytes.Contains(data, []byte("note")) || bytes.Contains(data, []byte("Skip")) {
+      t.Fatalf("AMF%d wrote skipped fields: % x", version, data)
+    }
+  }
+}
+
+func TestEmptyPropertyName(t *testing.T) {
+  obj := NewAMF0Object()
+  obj.AddValue("", 1.0)
+  arr := NewAMF0ECMAArray(0)
+  arr.AddValue("", 1.0)
+  assoc := NewAMF3Array(0)
+  assoc.AddAssocValue("", 1.0)
+  dyn := NewAMF3Object("", true)
+  dyn.AddDynValue("", 1.0)
+
+  for _, v := range []interface{}{map[string]interface{}{"": 1, "x": 2}, obj, arr, assoc, dyn} {
+    for _, version := range versions {
+      if data, err := MarshalValue(v, version); err == nil {
+        t.Fatalf("AMF%d encoded %#v as % x", version, v, data)
+      }
+    }
+  }
+
+  var buf bytes.Buffer
+  enc := NewEncoder(&buf, AMF0)
+  enc.SetMapsAsECMAArray(true)
+  if err := enc.Encode(map[string]int{"": 1}); err == nil {
+    t.Fatalf("Encoded % x", buf.Bytes())
+  }
+}
+
+func TestDates(t *testing.T) {
+  type dates struct {
+    T time.Time
+    P *time.Time
+  }
+
+  for _, d := range []time.Time{time.Date(2013, 5, 6, 7, 8, 9, 123e6, time.UTC), time.Date(1950, 5, 6, 7, 8, 9, 5e6, time.UTC)} {
+    for _, version := range versions {
+      var out dates
+      roundTrip(t, version, dates{d, &d}, &out)
+      if !out.T.Equal(d) || out.P == nil || !out.P.Equal(d) {
+        t.Fatalf("AMF%d got %v, want %v", version, out, d)
+      }
+    }
+  }
+
+  // The second date of the array refers back to the first one.
+  data := mustHex(t, "09050108014271" + "0d0e8a4b0000" + "0802")
+  var out []time.Time
+  if err := NewDecoder(bytes.NewReader(data), AMF3).Decode(&out); err != nil {
+    t.Fatal(err)
+  }
+  if len(out) != 2 || !out[0].Equal(out[1]) || out[0].IsZero() {
+    t.Fatalf("Got %v", out)
+  }
+}
+
+func TestNumbers(t *testing.T) {
+  in := []interface{}{0, 1, -1, 0x3fff, 0x4000, AMF3_INTEGER_MAX, AMF3_INTEGER_MIN, AMF3_INTEGER_MAX + 1, AMF3_INTEGER_MIN - 1, int64(1) << 40, uint8(200), 1.5, float32(2.5), int8(-5)}
+  want := []float64{0, 1, -1, 0x3fff, 0x4000, AMF3_INTEGER_MAX, AMF3_INTEGER_MIN, AMF3_INTEGER_MAX + 1, AMF3_INTEGER_MIN - 1, 1 << 40, 200, 1.5, 2.5, -5}
+  for _, version := range versions {
+    var out []float64
+    roundTrip(t, version, in, &out)
+    if !reflect.DeepEqual(out, want) {
+      t.Fatalf("AMF%d got %v", version, out)
+    }
+  }
+
+  var buf bytes.Buffer
+  enc := NewEncoder(&buf, AMF3)
+  enc.SetStrictIntegers(true)
+  if err := enc.Encode(int64(1) << 54 + 1); err == nil {
+    t.Fatal("Strict integers accepted an inexact value")
+  }
+  if err := enc.Encode(uint64(math.MaxUint32)); err != nil {
+    t.Fatal(err)
+  }
+}
+
+type testNamed struct {
+  A int
+}
+
+func (testNamed) AMFClassName() string {
+  return "com.example.Named"
+}
+
+type testPtrNamed struct {
+  A int
+}
+
+func (*testPtrNamed) AMFClassName() string {
+  return "com.example.PtrNamed"
+}
+
+func TestClassNamer(t *testing.T) {
+  tests := []struct {
+    v interface{}
+    className string
+  }{
+    {testNamed{1}, "com.example.Named"},
+    {&testNamed{1}, "com.example.Named"},
+    {&testPtrNamed{1}, "com.example.PtrNamed"},
+  }
+
+  for _, test := range tests {
+    data, err := MarshalAmf0(test.v)
+    if err != nil {
+      t.Fatal(err)
+    }
+    if data[0] != AMF0_TYPED_OBJECT_MARKER || !bytes.Contains(data, []byte(test.className)) {
+      t.Fatalf("%T encoded as % x", test.v, data)
+    }
+
+    v, err := UnmarshalAmf0(data)
+    if err != nil {
+      t.Fatal(err)
+    }
+    if obj, ok := v.(*AMF0TypedObject); !ok || obj.ClassName() != test.className {
+      t.Fatalf("%T decoded as %#v", test.v, v)
+    }
+
+    data, err = MarshalAmf3(test.v)
+    if err != nil {
+      t.Fatal(err)
+    }
+    if !bytes.Contains(data, []byte(test.className)) {
+      t.Fatalf("%T encoded in AMF3 as % x", test.v, data)
+    }
+  }
+}
+
+type testInt int32
+
+type testFloat float64
+
+func TestVectors(t *testing.T) {
+  tests := []struct {
+    in, out interface{}
+    marker byte
+  }{
+    {[]int32{-1, 2}, &[]int32{}, AMF3_VECTOR_INT_MARKER},
+    {[]uint32{3}, &[]uint32{}, AMF3_VECTOR_UINT_MARKER},
+    {[]float64{1.5}, &[]float64{}, AMF3_VECTOR_DOUBLE_MARKER},
+    {[]testInt{1, 2}, &[]testInt{}, AMF3_VECTOR_INT_MARKER},
+    {[]testFloat{2.5}, &[]testFloat{}, AMF3_VECTOR_DOUBLE_MARKER},
+  }
+
+  for _, test := range tests {
+    for _, version := range versions {
+      data := roundTrip(t, version, test.in, test.out)
+      if version == AMF3 && data[0] != test.marker {
+        t.Fatalf("%T encoded as % x", test.in, data)
+      }
+      if got := reflect.ValueOf(test.out).Elem().Interface(); !reflect.DeepEqual(got, test.in) {
+        t.Fatalf("AMF%d got %v, want %v", version, got, test.in)
+      }
+    }
+  }
+
+  vec := &Vector{Fixed: true, TypeName: "com.example.X", Values: []interface{}{"a", "b"}}
+  v, err := UnmarshalAmf3(mustMarshal(t, AMF3, vec))
+  if err != nil {
+    t.Fatal(err)
+  }
+  if got := v.(*Vector); !got.Fixed || got.TypeName != vec.TypeName || !reflect.DeepEqual(got.Values, vec.Values) {
+    t.Fatalf("Got %#v", got)
+  }
+}
+
+func mustMarshal(t *testing.T, version uint16, v interface{}) []byte {
+  data, err := MarshalValue(v, version)
+  if err != nil {
+    t.Fatal(err)
+  }
+  return data
+}
+
+func TestAMF3TypesInAMF0(t *testing.T) {
+  arr := NewAMF3Array(1)
+  arr.AddDenseValue(1.0)
+  arr.AddAssocValue("k", "v")
+  dict := NewDictionary(false)
+  dict.Set(true, "t")
+
+  for _, v := range []interface{}{arr, NewByteArray([]byte("raw")), dict, XML("<a/>")} {
+    data := mustMarshal(t, AMF0, v)
+    if data[0] != AMF0_ACMPLUS_OBJECT_MARKER {
+      t.Fatalf("%T encoded as % x", v, data)
+    }
+
+    got, err := UnmarshalAmf0(data)
+    if err != nil {
+      t.Fatal(err)
+    }
+    if !bytes.Equal(mustMarshal(t, AMF3, got), data[1:]) {
+      t.Fatalf("%T did not survive AMF0: %#v", v, got)
+    }
+  }
+}
+
+func TestECMAArray(t *testing.T) {
+  arr := NewAMF0ECMAArray(0)
+  arr.AddValue("duration", 1.5)
+  arr.AddValue("width", 640.0)
+  var meta struct {
+    Width int `amf:"width"`
+  }
+  roundTrip(t, AMF0, arr, &meta)
+  if meta.Width != 640 {
+    t.Fatalf("Got %+v", meta)
+  }
+
+  var buf bytes.Buffer
+  enc := NewEncoder(&buf, AMF0)
+  enc.SetMapsAsECMAArray(true)
+  if err := enc.Encode(map[string]string{"a": "b"}); err != nil {
+    t.Fatal(err)
+  }
+  if buf.Bytes()[0] != AMF0_ECMA_ARRAY_MARKER {
+    t.Fatalf("Map encoded as % x", buf.Bytes())
+  }
+}
+
+func TestDeterministic(t *testing.T) {
+  m := map[string]interface{}{}
+  for i := 0; i < 50; i++ {
+    m[string(rune('A' + i))] = i
+  }
+  dict := map[interface{}]int{3: 1, "x": 2, 1: 3, true: 4, 2.5: 5}
+
+  var first []byte
+  for i := 0; i < 20; i++ {
+    var buf bytes.Buffer
+    enc := NewEncoder(&buf, AMF3)
+    enc.SetDeterministic(true)
+    if err := enc.Encode([]interface{}{m, dict}); err != nil {
+      t.Fatal(err)
+    }
+
+    if first == nil {
+      first = buf.Bytes()
+    } else if !bytes.Equal(first, buf.Bytes()) {
+      t.Fatal("Deterministic encoding changed between runs")
+    }
+  }
+}
+
+func TestPropertyOrder(t *testing.T) {
+  obj := NewAMF0Object()
+  for _, k := range []string{"z", "a", "m", "b"} {
+    obj.AddValue(k, k)
+  }
+
+  data := mustMarshal(t, AMF0, obj)
+  v, err := UnmarshalAmf0(data)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if keys := v.(*AMF0Object).Keys(); !reflect.DeepEqual(keys, []string{"z", "a", "m", "b"}) {
+    t.Fatalf("Got keys %v", keys)
+  }
+  if !bytes.Equal(mustMarshal(t, AMF0, v), data) {
+    t.Fatal("Decoded object encodes differently")
+  }
+
+  data = mustMarshal(t, AMF3, obj)
+  v, err = UnmarshalAmf3(data)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if keys := v.(*AMF3Object).DynKeys(); !reflect.DeepEqual(keys, []string{"z", "a", "m", "b"}) {
+    t.Fatalf("Got dynamic keys %v", keys)
+  }
+}
+
+type testMoney struct {
+  cents int64
+}
+
+func (m testMoney) MarshalAMF(enc *Encoder) error {
+  return enc.Encode(float64(m.cents) / 100)
+}
+
+func (m *testMoney) UnmarshalAMF(dec *Decoder) error {
+  var f float64
+  err := dec.Decode(&f)
+  m.cents = int64(f * 100 + 0.5)
+  return err
+}
+
+type testOrder struct {
+  Price testMoney
+  Tax *testMoney
+}
+
+func TestMarshaler(t *testing.T) {
+  in := testOrder{testMoney{1234}, &testMoney{99}}
+  for _, version := range versions {
+    var out testOrder
+    roundTrip(t, version, in, &out)
+    if out.Price.cents != 1234 || out.Tax == nil || out.Tax.cents != 99 {
+      t.Fatalf("AMF%d got %+v", version, out)
+    }
+  }
+}
+
+// testRaw writes its bytes as they are.
+type testRaw []byte
+
+func (r testRaw) MarshalAMF(enc *Encoder) error {
+  _, err := enc.Write(r)
+  return err
+}
+
+func (r *testRaw) UnmarshalAMF(dec *Decoder) error {
+  *r = make(testRaw, 2)
+  _, err := dec.Read(*r)
+  return err
+}
+
+func TestRawMarshaler(t *testing.T) {
+  for _, version := range versions {
+    var buf bytes.Buffer
+    if err := NewEncoder(&buf, version).Encode(testRaw{1, 2}); err != nil {
+      t.Fatal(err)
+    }
+    var out testRaw
+    if err := NewDecoder(&buf, version).Decode(&out); err != nil || !bytes.Equal(out, testRaw{1, 2}) {
+      t.Fatalf("AMF%d got %v, %v", version, out, err)
+    }
+
+    // Nested raw bytes could not be read back.
+    for _, v := range []interface{}{struct{ R testRaw }{testRaw{1, 2}}, []interface{}{testRaw{1, 2}}} {
+      if err := NewEncoder(&buf, version).Encode(v); err == nil {
+        t.Fatalf("AMF%d encoded %#v", version, v)
+      }
+    }
+  }
+}
+
+type testPanic int
+
+func (p testPanic) MarshalAMF(enc *Encoder) error {
+  panic(int(p))
+}
+
+func (p *testPanic) UnmarshalAMF(dec *Decoder) error {
+  panic(int(*p))
+}
+
+func TestMarshalerPanic(t *testing.T) {
+  expectPanic := func(f func()) {
+    defer func() {
+      if r := recover(); r != 7 {
+        t.Fatalf("Got the panic %#v", r)
+      }
+    }()
+    f()
+  }
+
+  expectPanic(func() {
+    MarshalAmf3(struct{ P testPanic }{7})
+  })
+  expectPanic(func() {
+    out := struct{ P testPanic }{7}
+    Unmarshal(mustMarshal(t, AMF0, map[string]interface{}{"P": 1.0}), &out)
+  })
+}
+
+type testPoint struct {
+  X, Y int32
+}
+
+func (p *testPoint) ReadExternal(in DataInput) (err error) {
+  p.X, err = in.ReadInt()
+  if err == nil {
+    p.Y, err = in.ReadInt()
+  }
+  return
+}
+
+func (p *testPoint) WriteExternal(out DataOutput) error {
+  err := out.WriteInt(p.X)
+  if err == nil {
+    err = out.WriteInt(p.Y)
+  }
+  return err
+}
+
+func TestExternalizable(t *testing.T) {
+  RegisterClassAlias("com.example.Point", testPoint{})
+  p := &testPoint{1, 2}
+  coll := ArrayCollection{"a", "b"}
+
+  for _, version := range versions {
+    var out []interface{}
+    roundTrip(t, version, []interface{}{p, p, &coll, &ObjectProxy{"k": "v"}}, &out)
+    if *out[0].(*testPoint) != *p || out[0] != out[1] {
+      t.Fatalf("AMF%d got %#v", version, out)
+    }
+    if len(*out[2].(*ArrayCollection)) != 2 || (*out[3].(*ObjectProxy))["k"] != "v" {
+      t.Fatalf("AMF%d got %#v", version, out)
+    }
+  }
+}
+
+func TestStreamReferences(t *testing.T) {
+  var buf bytes.Buffer
+  enc := NewEncoder(&buf, AMF3)
+  for _, s := range []string{"hello", "world", "hello"} {
+    if err := enc.Encode(s); err != nil {
+      t.Fatal(err)
+    }
+  }
+  if n := bytes.Count(buf.Bytes(), []byte("hello")); n != 1 {
+    t.Fatalf("The repeated string was written %d times", n)
+  }
+
+  dec := NewDecoder(&buf, AMF3)
+  for _, want := range []string{"hello", "world", "hello"} {
+    var s string
+    if err := dec.Decode(&s); err != nil || s != want {
+      t.Fatalf("Got %q, %v, want %q", s, err, want)
+    }
+  }
+}
+
+func TestStreamResetReferences(t *testing.T) {
+  var buf bytes.Buffer
+  enc := NewEncoder(&buf, AMF3)
+  dec := NewDecoder(&buf, AMF3)
+  dec.SetLimits(DecodeLimits{MaxReferences: 2})
+
+  for i := 0; i < 10; i++ {
+    enc.ResetReferences()
+    dec.ResetReferences()
+    if err := enc.Encode([]string{"a", strconv.Itoa(i)}); err != nil {
+      t.Fatal(err)
+    }
+
+    var out []string
+    if err := dec.Decode(&out); err != nil || out[1] != strconv.Itoa(i) {
+      t.Fatalf("Message %d got %v, %v", i, out, err)
+    }
+  }
+}
+
+func TestStreamObjectIdentity(t *testing.T) {
+  var buf bytes.Buffer
+  enc := NewEncoder(&buf, AMF3)
+  for i := 0; i < 500; i++ {
+    if i % 50 == 0 {
+      runtime.GC()
+    }
+    if err := enc.Encode(&testAddress{strconv.Itoa(i)}); err != nil {
+      t.Fatal(err)
+    }
+  }
+
+  dec := NewDecoder(&buf, AMF3)
+  for i := 0; i < 500; i++ {
+    var a testAddress
+    if err := dec.Decode(&a); err != nil || a.City != strconv.Itoa(i) {
+      t.Fatalf("Value %d decoded as %+v, %v", i, a, err)
+    }
+  }
+}
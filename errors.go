@@ -0,0 +1,132 @@
+package goamf
+
+import (
+  "fmt"
+  "errors"
+  "strconv"
+)
+
+var (
+  // ErrUnsupportedMarker is the cause of a DecodeError for a marker that
+  // is unknown or can not be decoded at its position.
+  ErrUnsupportedMarker = errors.New("Unsupported AMF marker")
+  // ErrBadReference is the cause of a DecodeError for a string, object or
+  // traits reference that points outside its table.
+  ErrBadReference = errors.New("Bad AMF reference")
+  // ErrUnknownClass is the cause of a DecodeError for an externalizable
+  // class that is not registered with RegisterClassAlias.
+  ErrUnknownClass = errors.New("Unknown externalizable class")
+  // ErrMalformed is the cause of a DecodeError for an object that breaks
+  // the AMF format, as with repeated sealed members or a missing end marker.
+  ErrMalformed = errors.New("Malformed AMF object")
+  // ErrUnsupportedVersion is returned for an AMF version other than 0
+  // and 3.
+  ErrUnsupportedVersion = errors.New("AMF version must be 0 or 3")
+)
+
+// A DecodeError describes a value that could not be decoded. Offset is
+// the number of input bytes read when the error was detected, or -1 when
+// it is not known. Marker is the marker of the innermost value being
+// decoded and Path leads to that value from the top, as in
+// "messages[2].body[0].user.address".
+type DecodeError struct {
+  Offset int64
+  Marker byte
+  Version uint16
+  Path string
+  Err error
+}
+
+func (e *DecodeError) Error() string {
+  msg := "AMF" + strconv.Itoa(int(e.Version)) + " decode error"
+  if e.Offset >= 0 {
+    msg += " at offset " + strconv.FormatInt(e.Offset, 10)
+  }
+  msg += fmt.Sprintf(" (marker 0x%02x)", e.Marker)
+  if e.Path != "" {
+    msg += " in " + e.Path
+  }
+  return msg + ": " + e.Err.Error()
+}
+
+func (e *DecodeError) Unwrap() error {
+  return e.Err
+}
+
+// referenceError reports an index outside one of the reference tables.
+type referenceError string
+
+func (e referenceError) Error() string {
+  return "The index of " + string(e) + " ref is out of range"
+}
+
+func (e referenceError) Is(target error) bool {
+  return target == ErrBadReference
+}
+
+// classError reports an externalizable class without a registered type.
+type classError string
+
+func (e classError) Error() string {
+  return "Externalizable class " + string(e) + " is not registered"
+}
+
+func (e classError) Is(target error) bool {
+  return target == ErrUnknownClass
+}
+
+// formatError reports an object that breaks the AMF format.
+type formatError string
+
+func (e formatError) Error() string {
+  return string(e)
+}
+
+func (e formatError) Is(target error) bool {
+  return target == ErrMalformed
+}
+
+func (d *decodeState) offset() int64 {
+  switch r := d.Reader.(type) {
+  case *countingReader:
+    return r.n
+  case *ByteArray:
+    return int64(r.Position())
+  }
+  return -1
+}
+
+func (d *decodeState) decodeError(marker byte, err error) error {
+  if _, ok := err.(*DecodeError); ok {
+    return err
+  }
+  return &DecodeError{d.offset(), marker, d.version, "", err}
+}
+
+// keyPath and elemPath prepend the member k or the element i to the path
+// of a DecodeError from a nested value. Paths are built while unwinding,
+// so decoding pays nothing for them until something fails.
+func keyPath(err error, k string) error {
+  return prefixPath(err, k)
+}
+
+func elemPath(err error, i int) error {
+  return prefixPath(err, "[" + strconv.Itoa(i) + "]")
+}
+
+func prefixPath(err error, seg string) error {
+  de, ok := err.(*DecodeError)
+  if !ok {
+    return err
+  }
+
+  switch {
+  case de.Path == "":
+    de.Path = seg
+  case de.Path[0] == '[':
+    de.Path = seg + de.Path
+  default:
+    de.Path = seg + "." + de.Path
+  }
+  return err
+}
@@ -0,0 +1,275 @@
+package goamf
+
+import (
+  "errors"
+  "reflect"
+  "encoding/binary"
+)
+
+// Externalizable is implemented by types that write their own AMF3 body,
+// the equivalent of flash.utils.IExternalizable. The class must be
+// registered with RegisterClassAlias so that the decoder can create it
+// when it meets the class name in externalizable traits.
+type Externalizable interface {
+  ReadExternal(in DataInput) error
+  WriteExternal(out DataOutput) error
+}
+
+var externalizableType = reflect.TypeOf(new(Externalizable)).Elem()
+
+func init() {
+  RegisterClassAlias("flex.messaging.io.ArrayCollection", ArrayCollection{})
+  RegisterClassAlias("flex.messaging.io.ArrayList", ArrayList{})
+  RegisterClassAlias("flex.messaging.io.ObjectProxy", ObjectProxy{})
+}
+
+// ArrayCollection is mx.collections.ArrayCollection, which externalizes
+// its source array.
+type ArrayCollection []interface{}
+
+func (arr *ArrayCollection) ReadExternal(in DataInput) error {
+  values, err := readExternalSource(in)
+  *arr = values
+  return err
+}
+
+func (arr *ArrayCollection) WriteExternal(out DataOutput) error {
+  return out.WriteObject([]interface{}(*arr))
+}
+
+// ArrayList is mx.collections.ArrayList, which externalizes its source
+// array.
+type ArrayList []interface{}
+
+func (arr *ArrayList) ReadExternal(in DataInput) error {
+  values, err := readExternalSource(in)
+  *arr = values
+  return err
+}
+
+func (arr *ArrayList) WriteExternal(out DataOutput) error {
+  return out.WriteObject([]interface{}(*arr))
+}
+
+func readExternalSource(in DataInput) ([]interface{}, error) {
+  v, err := in.ReadObject()
+  if err != nil {
+    return nil, err
+  }
+
+  values, ok := arrayValues(v)
+  if !ok && v != nil {
+    return nil, errors.New("The source of externalized collection is not an array")
+  }
+  return values, nil
+}
+
+// ObjectProxy is mx.utils.ObjectProxy, which externalizes the properties
+// of the proxied object.
+type ObjectProxy map[string]interface{}
+
+func (proxy *ObjectProxy) ReadExternal(in DataInput) error {
+  v, err := in.ReadObject()
+  if err != nil {
+    return err
+  }
+
+  values, ok := objectValues(v)
+  if !ok && v != nil {
+    return errors.New("The proxied object of ObjectProxy is not an object")
+  }
+
+  *proxy = make(ObjectProxy, len(values))
+  for k, v := range values {
+    (*proxy)[k] = v
+  }
+  return nil
+}
+
+func (proxy *ObjectProxy) WriteExternal(out DataOutput) error {
+  return out.WriteObject(map[string]interface{}(*proxy))
+}
+
+// readExternal creates the registered Go value for the externalizable
+// traits and lets it read its body from the stream.
+func (d *decodeState) readExternal(traits *Traits) (interface{}, error) {
+  t, ok := aliasType(traits.ClassName)
+  if !ok || !reflect.PtrTo(t).Implements(externalizableType) {
+    return nil, classError(traits.ClassName)
+  }
+
+  v := reflect.New(t)
+  d.addObjectRef(v.Interface())
+  err := v.Interface().(Externalizable).ReadExternal(externalInput{d})
+  if err != nil {
+    return nil, err
+  }
+  return v.Interface(), nil
+}
+
+// AMF3_OBJECT_MARKER
+func externalizableEncoder(e *encodeState, v reflect.Value) error {
+  key := identity(v)
+  if v.Kind() != reflect.Ptr {
+    p := reflect.New(v.Type())
+    p.Elem().Set(v)
+    v = p
+  } else if v.IsNil() {
+    return nilValueEncoder(e, v)
+  }
+
+  className, ok := typeAlias(v.Type().Elem())
+  if namer, isNamer := v.Interface().(ClassNamer); isNamer {
+    className, ok = namer.AMFClassName(), true
+  }
+  if !ok || className == "" {
+    return errors.New("Externalizable type " + v.Type().String() + " has no class alias")
+  }
+
+  return e.avmPlus(func() error {
+    ref, err := writeObjectRef(e, AMF3_OBJECT_MARKER, key)
+    if ref || err != nil {
+      return err
+    }
+
+    err = writeObjectTraits(e, &Traits{ClassName: className, Externalizable: true})
+    if err != nil {
+      return err
+    }
+    return v.Interface().(Externalizable).WriteExternal(externalOutput{e})
+  })
+}
+
+// externalInput reads the body of an externalizable object straight from
+// the AMF3 stream, sharing its reference tables.
+type externalInput struct {
+  *decodeState
+}
+
+func (in externalInput) read(v interface{}) error {
+  return binary.Read(in, binary.BigEndian, v)
+}
+
+func (in externalInput) ReadBoolean() (bool, error) {
+  return readBoolean(in)
+}
+
+func (in externalInput) ReadSignedByte() (int8, error) {
+  b, err := in.ReadByte()
+  return int8(b), err
+}
+
+func (in externalInput) ReadUnsignedByte() (uint8, error) {
+  return in.ReadByte()
+}
+
+func (in externalInput) ReadShort() (n int16, err error) {
+  err = in.read(&n)
+  return
+}
+
+func (in externalInput) ReadUnsignedShort() (n uint16, err error) {
+  err = in.read(&n)
+  return
+}
+
+func (in externalInput) ReadInt() (n int32, err error) {
+  err = in.read(&n)
+  return
+}
+
+func (in externalInput) ReadUnsignedInt() (n uint32, err error) {
+  err = in.read(&n)
+  return
+}
+
+func (in externalInput) ReadFloat() (f float32, err error) {
+  err = in.read(&f)
+  return
+}
+
+func (in externalInput) ReadDouble() (f float64, err error) {
+  err = in.read(&f)
+  return
+}
+
+func (in externalInput) ReadUTF() (string, error) {
+  return readUTF8(in.decodeState)
+}
+
+func (in externalInput) ReadUTFBytes(length int) (string, error) {
+  data, err := in.ReadBytes(length)
+  return string(data), err
+}
+
+func (in externalInput) ReadBytes(length int) ([]byte, error) {
+  if length < 0 {
+    return nil, errors.New("The length of bytes is negative")
+  }
+
+  return in.readBytes(int64(length))
+}
+
+func (in externalInput) ReadObject() (interface{}, error) {
+  return in.unmarshal()
+}
+
+// externalOutput writes the body of an externalizable object straight
+// into the AMF3 stream, sharing its reference tables.
+type externalOutput struct {
+  *encodeState
+}
+
+func (out externalOutput) write(v interface{}) error {
+  return binary.Write(out, binary.BigEndian, v)
+}
+
+func (out externalOutput) WriteBoolean(b bool) error {
+  if b {
+    return out.WriteByte(0x01)
+  }
+  return out.WriteByte(0x00)
+}
+
+func (out externalOutput) WriteShort(n int16) error {
+  return out.write(n)
+}
+
+func (out externalOutput) WriteInt(n int32) error {
+  return out.write(n)
+}
+
+func (out externalOutput) WriteUnsignedInt(n uint32) error {
+  return out.write(n)
+}
+
+func (out externalOutput) WriteFloat(f float32) error {
+  return out.write(f)
+}
+
+func (out externalOutput) WriteDouble(f float64) error {
+  return out.write(f)
+}
+
+func (out externalOutput) WriteUTF(str string) error {
+  if len(str) > AMF0_MAX_STRING_LEN {
+    return errors.New("The length of UTF string is out of range")
+  }
+
+  _, err := writeUTF8(out, str)
+  return err
+}
+
+func (out externalOutput) WriteUTFBytes(str string) error {
+  _, err := out.WriteString(str)
+  return err
+}
+
+func (out externalOutput) WriteBytes(data []byte) error {
+  _, err := out.Write(data)
+  return err
+}
+
+func (out externalOutput) WriteObject(v interface{}) error {
+  return out.marshal(v)
+}
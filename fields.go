@@ -0,0 +1,233 @@
+package goamf
+
+import (
+  "sync"
+  "strings"
+  "reflect"
+)
+
+type field struct {
+  name string
+  index []int
+  typ reflect.Type
+  tagged bool
+  omitEmpty bool
+}
+
+var fieldCache struct {
+  sync.RWMutex
+  m map[reflect.Type][]field
+}
+
+// cachedTypeFields returns the AMF properties of struct type t. Fields are
+// named by their `amf` tag, or by the Go field name when the tag is empty.
+// A tag of "-" skips the field, the "omitempty" option leaves out empty
+// values when encoding and embedded structs are flattened.
+func cachedTypeFields(t reflect.Type) []field {
+  fieldCache.RLock()
+  fs := fieldCache.m[t]
+  fieldCache.RUnlock()
+  if fs != nil {
+    return fs
+  }
+
+  fs = typeFields(t)
+  if fs == nil {
+    fs = []field{}
+  }
+
+  fieldCache.Lock()
+  if fieldCache.m == nil {
+    fieldCache.m = make(map[reflect.Type][]field)
+  }
+  fieldCache.m[t] = fs
+  fieldCache.Unlock()
+  return fs
+}
+
+func typeFields(t reflect.Type) []field {
+  current := []field{}
+  next := []field{{typ: t}}
+  visited := make(map[reflect.Type]bool)
+
+  fields := make([]field, 0, t.NumField())
+  for len(next) > 0 {
+    current, next = next, current[:0]
+    count := make(map[string]int)
+    level := make([]field, 0)
+
+    for _, f := range current {
+      if visited[f.typ] {
+        continue
+      }
+      visited[f.typ] = true
+
+      for i := 0; i < f.typ.NumField(); i++ {
+        sf := f.typ.Field(i)
+        if sf.PkgPath != "" && !sf.Anonymous {
+          continue
+        }
+
+        tag := sf.Tag.Get("amf")
+        if tag == "-" {
+          continue
+        }
+        name, opts := tag, ""
+        if i := strings.Index(tag, ","); i != -1 {
+          name, opts = tag[:i], tag[i+1:]
+        }
+
+        index := make([]int, len(f.index)+1)
+        copy(index, f.index)
+        index[len(f.index)] = i
+
+        ft := sf.Type
+        if ft.Name() == "" && ft.Kind() == reflect.Ptr {
+          ft = ft.Elem()
+        }
+
+        if name == "" && sf.Anonymous && ft.Kind() == reflect.Struct {
+          if sf.PkgPath != "" && sf.Type.Kind() == reflect.Ptr {
+            continue
+          }
+          next = append(next, field{name: ft.Name(), index: index, typ: ft})
+          continue
+        }
+        if sf.PkgPath != "" {
+          continue
+        }
+
+        tagged := name != ""
+        if name == "" {
+          name = sf.Name
+        }
+        level = append(level, field{name, index, sf.Type, tagged, hasOption(opts, "omitempty")})
+        count[name]++
+      }
+    }
+
+    for _, f := range level {
+      if dominated(fields, f.name) {
+        continue
+      }
+      if count[f.name] > 1 && !dominantTag(level, f) {
+        continue
+      }
+      fields = append(fields, f)
+    }
+  }
+
+  return fields
+}
+
+func hasOption(opts, name string) bool {
+  for opts != "" {
+    opt := opts
+    if i := strings.Index(opts, ","); i != -1 {
+      opt, opts = opts[:i], opts[i+1:]
+    } else {
+      opts = ""
+    }
+    if opt == name {
+      return true
+    }
+  }
+  return false
+}
+
+func dominated(fields []field, name string) bool {
+  for _, f := range fields {
+    if f.name == name {
+      return true
+    }
+  }
+  return false
+}
+
+func dominantTag(level []field, f field) bool {
+  if !f.tagged {
+    return false
+  }
+
+  for _, other := range level {
+    if other.name == f.name && other.tagged && !sameIndex(other.index, f.index) {
+      return false
+    }
+  }
+  return true
+}
+
+func sameIndex(a, b []int) bool {
+  if len(a) != len(b) {
+    return false
+  }
+  for i := range a {
+    if a[i] != b[i] {
+      return false
+    }
+  }
+  return true
+}
+
+func findField(fields []field, name string) *field {
+  for i := range fields {
+    if fields[i].name == name {
+      return &fields[i]
+    }
+  }
+
+  for i := range fields {
+    if strings.EqualFold(fields[i].name, name) {
+      return &fields[i]
+    }
+  }
+  return nil
+}
+
+// fieldByIndex walks index from the struct v, allocating nil embedded
+// pointers on the way so the field can be set.
+func fieldByIndex(v reflect.Value, index []int) reflect.Value {
+  for i, x := range index {
+    if i > 0 && v.Kind() == reflect.Ptr {
+      if v.IsNil() {
+        v.Set(reflect.New(v.Type().Elem()))
+      }
+      v = v.Elem()
+    }
+    v = v.Field(x)
+  }
+  return v
+}
+
+// fieldValue walks index from the struct v for encoding. It reports false
+// when a nil embedded pointer hides the field.
+func fieldValue(v reflect.Value, index []int) (reflect.Value, bool) {
+  for i, x := range index {
+    if i > 0 && v.Kind() == reflect.Ptr {
+      if v.IsNil() {
+        return reflect.Value{}, false
+      }
+      v = v.Elem()
+    }
+    v = v.Field(x)
+  }
+  return v, true
+}
+
+func isEmptyValue(v reflect.Value) bool {
+  switch v.Kind() {
+  case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+    return v.Len() == 0
+  case reflect.Bool:
+    return !v.Bool()
+  case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+    return v.Int() == 0
+  case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+    return v.Uint() == 0
+  case reflect.Float32, reflect.Float64:
+    return v.Float() == 0
+  case reflect.Interface, reflect.Ptr:
+    return v.IsNil()
+  }
+  return false
+}
@@ -0,0 +1,239 @@
+package goamf
+
+import (
+  "fmt"
+  "sync"
+  "bytes"
+  "context"
+  "net/http"
+)
+
+// AMFContentType is the content type of remoting requests and responses.
+const AMFContentType = "application/x-amf"
+
+// A RemotingFunc handles the calls of one remoting target. The context is
+// the one of the HTTP request and carries the request and the packet
+// headers, see RequestFromContext and HeadersFromContext.
+type RemotingFunc func(ctx context.Context, args []interface{}) (interface{}, error)
+
+// A Fault is the status object sent back on onStatus when a call fails.
+// Handlers may return a *Fault to choose its code.
+type Fault struct {
+  Level string `amf:"level"`
+  Code string `amf:"code"`
+  Description string `amf:"description"`
+  Details string `amf:"details,omitempty"`
+}
+
+func (f *Fault) Error() string {
+  if f.Code == "" {
+    return f.Description
+  }
+  return f.Code + ": " + f.Description
+}
+
+// A Gateway is a Flash Remoting endpoint. It decodes the request packet,
+// calls the handler of every message target, such as
+// "UserService.getUser", and answers each message on its response URI
+// with "/onResult" or "/onStatus". Flex RemotingMessages sent to the
+// "null" target are dispatched by destination and operation and answered
+// with AcknowledgeMessages or ErrorMessages.
+type Gateway struct {
+  mu sync.RWMutex
+  handlers map[string]RemotingFunc
+  limits *DecodeLimits
+  credentials CredentialsFunc
+  understood map[string]bool
+}
+
+// NewGateway returns a gateway without any targets.
+func NewGateway() *Gateway {
+  return &Gateway{handlers: make(map[string]RemotingFunc), understood: make(map[string]bool)}
+}
+
+// HandleFunc registers f for target, a service name and a method name
+// joined by a dot.
+func (g *Gateway) HandleFunc(target string, f RemotingFunc) {
+  if target == "" || f == nil {
+    panic("goamf: HandleFunc needs a target and a function")
+  }
+
+  g.mu.Lock()
+  defer g.mu.Unlock()
+  g.handlers[target] = f
+}
+
+// SetLimits bounds the resources spent on decoding request packets.
+func (g *Gateway) SetLimits(limits DecodeLimits) {
+  g.limits = &limits
+}
+
+func (g *Gateway) handler(target string) (RemotingFunc, bool) {
+  g.mu.RLock()
+  defer g.mu.RUnlock()
+  f, ok := g.handlers[target]
+  return f, ok
+}
+
+func (g *Gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+  if r.Method != "POST" {
+    w.Header().Set("Allow", "POST")
+    http.Error(w, "AMF gateway only accepts POST", http.StatusMethodNotAllowed)
+    return
+  }
+
+  dec := NewDecoder(r.Body, AMF0)
+  if g.limits != nil {
+    dec.SetLimits(*g.limits)
+  }
+  req, err := dec.DecodePacket()
+  if err != nil {
+    http.Error(w, "Bad AMF packet: " + err.Error(), http.StatusBadRequest)
+    return
+  }
+
+  info := &callInfo{request: r, headers: req.Headers, version: req.Version}
+  ctx := withCallInfo(r.Context(), info)
+  info.fault = g.checkHeaders(ctx, req.Headers, req.Version)
+  resp, err := g.serve(ctx, req)
+  if err == nil {
+    var buf bytes.Buffer
+    err = NewEncoder(&buf, AMF0).Encode(resp)
+    if err == nil {
+      w.Header().Set("Content-Type", AMFContentType)
+      w.Write(buf.Bytes())
+      return
+    }
+  }
+  http.Error(w, err.Error(), http.StatusInternalServerError)
+}
+
+// serve answers the messages of req in order. Headers added by the calls
+// go into the response.
+func (g *Gateway) serve(ctx context.Context, req *Packet) (*Packet, error) {
+  resp, err := NewAmfPacket(req.Version)
+  if err != nil {
+    return nil, err
+  }
+
+  for _, message := range req.Messages {
+    status, v := g.dispatch(ctx, message)
+    err = resp.AddMessage(message.ResponseUri + status, "null", v)
+    if err != nil {
+      return nil, err
+    }
+  }
+
+  resp.Headers = append(resp.Headers, contextCallInfo(ctx).responseHeaders...)
+  return resp, nil
+}
+
+// dispatch calls the handler of message and returns the response suffix
+// with the response value.
+func (g *Gateway) dispatch(ctx context.Context, message PacketMessage) (string, interface{}) {
+  args, ok := arrayValues(message.Value)
+  if !ok {
+    args = []interface{}{message.Value}
+  }
+
+  if len(args) == 1 {
+    switch m := args[0].(type) {
+    case *RemotingMessage:
+      return g.dispatchRemoting(ctx, m)
+    case *CommandMessage:
+      return dispatchCommand(ctx, m)
+    case *CommandMessageExt:
+      return dispatchCommand(ctx, &m.CommandMessage)
+    }
+  }
+
+  result, err := g.call(ctx, message.TargetUri, args)
+  if err != nil {
+    return "/onStatus", newFault(err)
+  }
+  return "/onResult", result
+}
+
+func (g *Gateway) dispatchRemoting(ctx context.Context, m *RemotingMessage) (string, interface{}) {
+  args, ok := arrayValues(m.Body)
+  if !ok && m.Body != nil {
+    args = []interface{}{m.Body}
+  }
+
+  result, err := g.call(ctx, m.Destination + "." + m.Operation, args)
+  if err != nil {
+    return "/onStatus", newErrorMessage(&m.AbstractMessage, err)
+  }
+
+  ack := NewAcknowledgeMessage(m.MessageId, result)
+  ack.ClientId = m.ClientId
+  ack.Destination = m.Destination
+  return "/onResult", ack
+}
+
+// dispatchCommand acknowledges a command such as the ping with which a
+// Flex channel connects, unless the headers of the request failed.
+func dispatchCommand(ctx context.Context, m *CommandMessage) (string, interface{}) {
+  if fault := contextCallInfo(ctx).fault; fault != nil {
+    return "/onStatus", newErrorMessage(&m.AbstractMessage, fault)
+  }
+  return "/onResult", commandAck(m)
+}
+
+// newErrorMessage answers the message m with the fault err.
+func newErrorMessage(m *AbstractMessage, err error) *ErrorMessage {
+  fault := newFault(err)
+  em := NewErrorMessage(m.MessageId, fault.Code, fault.Description)
+  em.ClientId = m.ClientId
+  em.Destination = m.Destination
+  em.FaultDetail = fault.Details
+  if e, ok := err.(*ErrorMessage); ok {
+    em.RootCause, em.ExtendedData = e.RootCause, e.ExtendedData
+  }
+  return em
+}
+
+// commandAck acknowledges the command m. The client id is handed out here
+// when the client has none.
+func commandAck(m *CommandMessage) *AcknowledgeMessage {
+  ack := NewAcknowledgeMessage(m.MessageId, nil)
+  ack.ClientId = m.ClientId
+  if ack.ClientId == "" {
+    ack.ClientId = NewMessageId()
+  }
+  ack.Headers["DSId"] = ack.ClientId
+  return ack
+}
+
+func (g *Gateway) call(ctx context.Context, target string, args []interface{}) (result interface{}, err error) {
+  if fault := contextCallInfo(ctx).fault; fault != nil {
+    return nil, fault
+  }
+
+  f, ok := g.handler(target)
+  if !ok {
+    return nil, &Fault{"error", "Server.ResourceNotFound", "No such remoting target " + target, ""}
+  }
+
+  defer func() {
+    if r := recover(); r != nil {
+      result, err = nil, &Fault{"error", "Server.Processing", fmt.Sprint("Remoting target ", target, " panicked: ", r), ""}
+    }
+  }()
+  return f(ctx, args)
+}
+
+func newFault(err error) *Fault {
+  switch e := err.(type) {
+  case *Fault:
+    if e.Level == "" {
+      f := *e
+      f.Level = "error"
+      return &f
+    }
+    return e
+  case *ErrorMessage:
+    return &Fault{"error", e.FaultCode, e.FaultString, e.FaultDetail}
+  }
+  return &Fault{"error", "Server.Processing", err.Error(), ""}
+}
@@ -0,0 +1,350 @@
+package goamf
+
+import (
+  "bytes"
+  "errors"
+  "context"
+  "strings"
+  "sync"
+  "testing"
+  "net/http"
+  "net/http/httptest"
+)
+
+func postPacket(t *testing.T, h http.Handler, p *Packet) *httptest.ResponseRecorder {
+  r := httptest.NewRequest("POST", "/gateway", bytes.NewReader(mustPacket(t, p)))
+  r.Header.Set("Content-Type", AMFContentType)
+  w := httptest.NewRecorder()
+  h.ServeHTTP(w, r)
+  return w
+}
+
+// callGateway sends one call of target with args to h and returns the
+// response packet.
+func callGateway(t *testing.T, h http.Handler, version uint16, headers []PacketHeader, target string, args ...interface{}) *Packet {
+  p, err := NewAmfPacket(version)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if args == nil {
+    args = []interface{}{}
+  }
+  p.Headers = append(p.Headers, headers...)
+  p.AddMessage(target, "/1", args)
+
+  w := postPacket(t, h, p)
+  if w.Code != http.StatusOK || w.Header().Get("Content-Type") != AMFContentType {
+    t.Fatalf("Got status %d: %s", w.Code, w.Body.String())
+  }
+  resp, err := UnmarshalPacket(w.Body.Bytes())
+  if err != nil {
+    t.Fatal(err)
+  }
+  if resp.Version != version || len(resp.Messages) != 1 {
+    t.Fatalf("Got %#v", resp)
+  }
+  return resp
+}
+
+// expectResult checks that resp answers the call on onResult and stores
+// the result in v.
+func expectResult(t *testing.T, resp *Packet, v interface{}) {
+  m := resp.Messages[0]
+  if m.TargetUri != "/1/onResult" {
+    t.Fatalf("Got %s with %#v", m.TargetUri, m.Value)
+  }
+  if err := (&Result{m.Value, resp.Version}).Decode(v); err != nil {
+    t.Fatal(err)
+  }
+}
+
+// expectFault checks that resp answers the call on onStatus with the
+// fault code and returns the error.
+func expectFault(t *testing.T, resp *Packet, code string) error {
+  m := resp.Messages[0]
+  if m.TargetUri != "/1/onStatus" {
+    t.Fatalf("Got %s with %#v", m.TargetUri, m.Value)
+  }
+
+  err := statusError(m.Value, resp.Version)
+  var gotCode string
+  switch e := err.(type) {
+  case *Fault:
+    gotCode = e.Code
+  case *ErrorMessage:
+    gotCode = e.FaultCode
+  }
+  if gotCode != code {
+    t.Fatalf("Got %v, want the code %s", err, code)
+  }
+  return err
+}
+
+func newTestGateway() *Gateway {
+  g := NewGateway()
+  g.HandleFunc("Echo.echo", func(ctx context.Context, args []interface{}) (interface{}, error) {
+    return args, nil
+  })
+  g.HandleFunc("Echo.fail", func(ctx context.Context, args []interface{}) (interface{}, error) {
+    return nil, &Fault{Code: "App.Failed", Description: "failed"}
+  })
+  g.HandleFunc("Echo.panic", func(ctx context.Context, args []interface{}) (interface{}, error) {
+    panic("boom")
+  })
+  return g
+}
+
+func TestGatewayHandleFunc(t *testing.T) {
+  g := newTestGateway()
+  for _, version := range versions {
+    var args []string
+    expectResult(t, callGateway(t, g, version, nil, "Echo.echo", "a", "b"), &args)
+    if strings.Join(args, ",") != "a,b" {
+      t.Fatalf("AMF%d got %v", version, args)
+    }
+
+    expectFault(t, callGateway(t, g, version, nil, "Echo.fail"), "App.Failed")
+    expectFault(t, callGateway(t, g, version, nil, "Echo.missing"), "Server.ResourceNotFound")
+    expectFault(t, callGateway(t, g, version, nil, "Echo.panic"), "Server.Processing")
+  }
+}
+
+func TestGatewayBatch(t *testing.T) {
+  g := newTestGateway()
+  p, _ := NewAmfPacket(AMF3)
+  p.AddMessage("Echo.echo", "/1", []interface{}{"a"})
+  p.AddMessage("Echo.fail", "/2", []interface{}{})
+  p.AddMessage("Echo.echo", "/3", []interface{}{"c"})
+
+  resp, err := UnmarshalPacket(postPacket(t, g, p).Body.Bytes())
+  if err != nil {
+    t.Fatal(err)
+  }
+  var uris []string
+  for _, m := range resp.Messages {
+    uris = append(uris, m.TargetUri)
+  }
+  if strings.Join(uris, " ") != "/1/onResult /2/onStatus /3/onResult" {
+    t.Fatalf("Got %v", uris)
+  }
+}
+
+func TestGatewayBadRequests(t *testing.T) {
+  g := newTestGateway()
+
+  w := httptest.NewRecorder()
+  g.ServeHTTP(w, httptest.NewRequest("GET", "/gateway", nil))
+  if w.Code != http.StatusMethodNotAllowed || w.Header().Get("Allow") != "POST" {
+    t.Fatalf("Got status %d", w.Code)
+  }
+
+  w = httptest.NewRecorder()
+  g.ServeHTTP(w, httptest.NewRequest("POST", "/gateway", strings.NewReader("\x00\x09")))
+  if w.Code != http.StatusBadRequest {
+    t.Fatalf("Got status %d", w.Code)
+  }
+}
+
+func TestGatewayLimits(t *testing.T) {
+  g := newTestGateway()
+  g.SetLimits(DecodeLimits{MaxStringLength: 10})
+
+  p, _ := NewAmfPacket(AMF0)
+  p.AddMessage("Echo.echo", "/1", []interface{}{strings.Repeat("x", 11)})
+  if code := postPacket(t, g, p).Code; code != http.StatusBadRequest {
+    t.Fatalf("Got status %d", code)
+  }
+}
+
+type testUser struct {
+  Id int `amf:"id"`
+  Name string `amf:"name"`
+}
+
+// testBaseService provides operations by embedding.
+type testBaseService struct{}
+
+func (testBaseService) GetUser(id int) (*testUser, error) {
+  return nil, errors.New("Not implemented")
+}
+
+func (testBaseService) Ping() string {
+  return "pong"
+}
+
+type testUserService struct {
+  testBaseService
+  sync.Mutex
+  users map[int]*testUser
+}
+
+func (s *testUserService) GetUser(id int) (*testUser, error) {
+  s.Lock()
+  defer s.Unlock()
+  u, ok := s.users[id]
+  if !ok {
+    return nil, errors.New("No such user")
+  }
+  return u, nil
+}
+
+func (s *testUserService) SaveUser(ctx context.Context, u testUser) error {
+  if _, ok := RequestFromContext(ctx); !ok {
+    return errors.New("No request in the context")
+  }
+  s.Lock()
+  defer s.Unlock()
+  s.users[u.Id] = &u
+  return nil
+}
+
+func (s *testUserService) Count(ids ...int) int {
+  return len(ids)
+}
+
+func (s *testUserService) Pair() (int, int) {
+  return 0, 0
+}
+
+func TestGatewayRegister(t *testing.T) {
+  g := NewGateway()
+  if err := g.Register("UserService", &testUserService{users: map[int]*testUser{1: {1, "bob"}}}); err != nil {
+    t.Fatal(err)
+  }
+
+  for _, version := range versions {
+    var u testUser
+    expectResult(t, callGateway(t, g, version, nil, "UserService.getUser", 1), &u)
+    if u.Name != "bob" {
+      t.Fatalf("AMF%d got %+v", version, u)
+    }
+
+    expectFault(t, callGateway(t, g, version, nil, "UserService.getUser", 2), "Server.Processing")
+    expectFault(t, callGateway(t, g, version, nil, "UserService.getUser"), "Server.Processing")
+    expectFault(t, callGateway(t, g, version, nil, "UserService.getUser", "x"), "Server.Processing")
+
+    var n int
+    expectResult(t, callGateway(t, g, version, nil, "UserService.count", 1, 2, 3), &n)
+    if n != 3 {
+      t.Fatalf("AMF%d got %d", version, n)
+    }
+  }
+
+  callGateway(t, g, AMF3, nil, "UserService.saveUser", &testUser{2, "alice"})
+  var u testUser
+  expectResult(t, callGateway(t, g, AMF3, nil, "UserService.getUser", 2), &u)
+  if u.Name != "alice" {
+    t.Fatalf("Got %+v", u)
+  }
+
+  for _, target := range []string{"UserService.lock", "UserService.unlock", "UserService.ping", "UserService.pair"} {
+    if _, ok := g.handler(target); ok {
+      t.Fatalf("%s was registered", target)
+    }
+  }
+
+  if err := g.Register("Base", testBaseService{}); err != nil {
+    t.Fatal(err)
+  }
+  var pong string
+  expectResult(t, callGateway(t, g, AMF0, nil, "Base.ping"), &pong)
+  if pong != "pong" {
+    t.Fatalf("Got %q", pong)
+  }
+
+  if err := g.Register("Empty", &struct{ sync.Mutex }{}); err == nil {
+    t.Fatal("A service without methods was registered")
+  }
+}
+
+func TestGatewayFlex(t *testing.T) {
+  g := newTestGateway()
+
+  ping := &CommandMessage{Operation: CLIENT_PING_OPERATION}
+  ping.MessageId = NewMessageId()
+  var ack AcknowledgeMessage
+  expectResult(t, callGateway(t, g, AMF3, nil, "null", ping), &ack)
+  if ack.CorrelationId != ping.MessageId || ack.ClientId == "" || ack.Headers["DSId"] != ack.ClientId {
+    t.Fatalf("Got %+v", ack)
+  }
+
+  rm := NewRemotingMessage("Echo", "echo", "a")
+  rm.ClientId = ack.ClientId
+  ack = AcknowledgeMessage{}
+  expectResult(t, callGateway(t, g, AMF3, nil, "null", rm), &ack)
+  var args []string
+  if err := (&Result{ack.Body, AMF3}).Decode(&args); err != nil || len(args) != 1 || args[0] != "a" {
+    t.Fatalf("Got %+v, %v", ack, err)
+  }
+  if ack.CorrelationId != rm.MessageId || ack.ClientId != rm.ClientId {
+    t.Fatalf("Got %+v", ack)
+  }
+
+  rm = NewRemotingMessage("Echo", "fail")
+  err := expectFault(t, callGateway(t, g, AMF3, nil, "null", rm), "App.Failed")
+  if em, ok := err.(*ErrorMessage); !ok || em.CorrelationId != rm.MessageId {
+    t.Fatalf("Got %#v", err)
+  }
+}
+
+func TestGatewayCredentials(t *testing.T) {
+  g := newTestGateway()
+  g.SetCredentialsHandler(func(ctx context.Context, userid, password string) error {
+    if userid != "bob" || password != "secret" {
+      return errors.New("Wrong password")
+    }
+    return nil
+  })
+
+  good := []PacketHeader{{HeaderCredentials, 0, &Credentials{"bob", "secret"}}}
+  bad := []PacketHeader{{HeaderCredentials, 0, &Credentials{"bob", "guess"}}}
+  for _, version := range versions {
+    var args []string
+    expectResult(t, callGateway(t, g, version, good, "Echo.echo", "a"), &args)
+    expectFault(t, callGateway(t, g, version, bad, "Echo.echo", "a"), "Client.Authentication")
+    expectFault(t, callGateway(t, g, version, nil, "Echo.echo", "a"), "Client.Authentication")
+  }
+
+  // Commands fail as well, so a Flex channel can not connect without
+  // valid credentials.
+  ping := &CommandMessage{Operation: CLIENT_PING_OPERATION}
+  ping.MessageId = NewMessageId()
+  err := expectFault(t, callGateway(t, g, AMF3, bad, "null", ping), "Client.Authentication")
+  if em, ok := err.(*ErrorMessage); !ok || em.CorrelationId != ping.MessageId {
+    t.Fatalf("Got %#v", err)
+  }
+  var ack AcknowledgeMessage
+  expectResult(t, callGateway(t, g, AMF3, good, "null", ping), &ack)
+}
+
+func TestGatewayHeaders(t *testing.T) {
+  g := NewGateway()
+  g.HandleFunc("Session.get", func(ctx context.Context, args []interface{}) (interface{}, error) {
+    v, _ := HeaderFromContext(ctx, "Session")
+    AddResponseHeader(ctx, HeaderAppendToGatewayUrl, false, "?sid=1")
+    return v, nil
+  })
+
+  headers := []PacketHeader{{"Session", 1, "abc"}}
+  expectFault(t, callGateway(t, g, AMF0, headers, "Session.get"), "Client.MustUnderstand")
+
+  // Headers that need not be understood are fine either way.
+  var s string
+  expectResult(t, callGateway(t, g, AMF0, []PacketHeader{{"Other", 0, "x"}}, "Session.get"), &s)
+
+  g.UnderstandHeaders("Session")
+  for _, version := range versions {
+    resp := callGateway(t, g, version, headers, "Session.get")
+    expectResult(t, resp, &s)
+    if s != "abc" {
+      t.Fatalf("AMF%d got %q", version, s)
+    }
+    if len(resp.Headers) != 1 || resp.Headers[0].HeaderName != HeaderAppendToGatewayUrl || resp.Headers[0].Value != "?sid=1" {
+      t.Fatalf("AMF%d got headers %#v", version, resp.Headers)
+    }
+  }
+
+  if err := AddResponseHeader(context.Background(), "x", false, nil); err == nil {
+    t.Fatal("A header was added outside of a call")
+  }
+}
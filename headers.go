@@ -0,0 +1,179 @@
+package goamf
+
+import (
+  "errors"
+  "context"
+  "reflect"
+)
+
+// The standard Flash Remoting headers.
+const (
+  // HeaderCredentials carries the Credentials of the caller.
+  HeaderCredentials = "Credentials"
+  // HeaderAppendToGatewayUrl carries a string the client appends to the
+  // gateway URL, such as a session id.
+  HeaderAppendToGatewayUrl = "AppendToGatewayUrl"
+  // HeaderReplaceGatewayUrl carries the URL the client uses from then on.
+  HeaderReplaceGatewayUrl = "ReplaceGatewayUrl"
+  // HeaderRequestPersistentHeader carries a PersistentHeader the client
+  // sends with every later request.
+  HeaderRequestPersistentHeader = "RequestPersistentHeader"
+)
+
+// Credentials is the value of the Credentials header, as set by
+// NetConnection.setCredentials.
+type Credentials struct {
+  Userid string `amf:"userid"`
+  Password string `amf:"password"`
+}
+
+// PersistentHeader is the value of the RequestPersistentHeader header.
+type PersistentHeader struct {
+  Name string `amf:"name"`
+  MustUnderstand bool `amf:"mustUnderstand"`
+  Data interface{} `amf:"data"`
+}
+
+// A CredentialsFunc checks the credentials of a request. Both are empty
+// when the request has no Credentials header.
+type CredentialsFunc func(ctx context.Context, userid, password string) error
+
+// SetCredentials makes the client send the Credentials header with every
+// request.
+func (c *Client) SetCredentials(userid, password string) {
+  c.AddHeader(HeaderCredentials, false, &Credentials{userid, password})
+}
+
+// AddHeader makes the client send the header name with every request, the
+// equivalent of NetConnection.addHeader. A nil value removes the header.
+func (c *Client) AddHeader(name string, mustUnderstand bool, value interface{}) {
+  c.mu.Lock()
+  defer c.mu.Unlock()
+
+  headers := make([]PacketHeader, 0, len(c.headers) + 1)
+  for _, header := range c.headers {
+    if header.HeaderName != name {
+      headers = append(headers, header)
+    }
+  }
+  if value != nil {
+    headers = append(headers, PacketHeader{name, boolU8(mustUnderstand), value})
+  }
+  c.headers = headers
+}
+
+func boolU8(b bool) uint8 {
+  if b {
+    return 1
+  }
+  return 0
+}
+
+// requestTarget returns the gateway URL and the headers of the next
+// request.
+func (c *Client) requestTarget() (string, []PacketHeader) {
+  c.mu.Lock()
+  defer c.mu.Unlock()
+  return c.url, c.headers
+}
+
+// handleHeaders applies the headers of a response packet to the client.
+// AppendToGatewayUrl is appended to the URL the client was created with,
+// or last replaced with, so gateways may repeat it on every response.
+// Other headers are ignored.
+func (c *Client) handleHeaders(headers []PacketHeader, version uint16) {
+  for _, header := range headers {
+    switch header.HeaderName {
+    case HeaderAppendToGatewayUrl:
+      if str, ok := header.Value.(string); ok {
+        c.mu.Lock()
+        c.url = c.baseUrl + str
+        c.mu.Unlock()
+      }
+    case HeaderReplaceGatewayUrl:
+      if str, ok := header.Value.(string); ok && str != "" {
+        c.mu.Lock()
+        c.baseUrl, c.url = str, str
+        c.mu.Unlock()
+      }
+    case HeaderRequestPersistentHeader:
+      var ph PersistentHeader
+      if assignValue(reflect.ValueOf(&ph).Elem(), header.Value, version) == nil && ph.Name != "" {
+        c.AddHeader(ph.Name, ph.MustUnderstand, ph.Data)
+      }
+    }
+  }
+}
+
+// SetCredentialsHandler sets f to check the credentials of every request.
+// When f fails, all messages of the request are answered with its error
+// as the fault, or a fault with the code "Client.Authentication".
+func (g *Gateway) SetCredentialsHandler(f CredentialsFunc) {
+  g.mu.Lock()
+  defer g.mu.Unlock()
+  g.credentials = f
+}
+
+// UnderstandHeaders declares the headers that the services of the gateway
+// read, see HeaderFromContext. A request with another header that must be
+// understood, apart from Credentials, is answered with faults.
+func (g *Gateway) UnderstandHeaders(names ...string) {
+  g.mu.Lock()
+  defer g.mu.Unlock()
+  for _, name := range names {
+    g.understood[name] = true
+  }
+}
+
+// AddResponseHeader adds a header to the response packet of the remoting
+// call that ctx belongs to, such as AppendToGatewayUrl with a session id.
+func AddResponseHeader(ctx context.Context, name string, mustUnderstand bool, value interface{}) error {
+  info, _ := ctx.Value(callInfoKey{}).(*callInfo)
+  if info == nil {
+    return errors.New("The context does not belong to a remoting call")
+  }
+
+  info.responseHeaders = append(info.responseHeaders, PacketHeader{name, boolU8(mustUnderstand), value})
+  return nil
+}
+
+// checkHeaders checks the credentials and the headers that must be
+// understood of a request.
+func (g *Gateway) checkHeaders(ctx context.Context, headers []PacketHeader, version uint16) error {
+  g.mu.RLock()
+  credentials := g.credentials
+  g.mu.RUnlock()
+
+  var cred Credentials
+  for _, header := range headers {
+    if header.HeaderName == HeaderCredentials {
+      err := assignValue(reflect.ValueOf(&cred).Elem(), header.Value, version)
+      if err != nil {
+        return &Fault{"error", "Client.Authentication", "Bad credentials header: " + err.Error(), ""}
+      }
+      continue
+    }
+
+    g.mu.RLock()
+    understood := g.understood[header.HeaderName]
+    g.mu.RUnlock()
+    if header.MustUnderstand != 0 && !understood {
+      return &Fault{"error", "Client.MustUnderstand", "The header " + header.HeaderName + " is not understood", ""}
+    }
+  }
+
+  if credentials == nil {
+    return nil
+  }
+  err := credentials(ctx, cred.Userid, cred.Password)
+  if err == nil {
+    return nil
+  }
+  if _, ok := err.(*Fault); ok {
+    return err
+  }
+  if _, ok := err.(*ErrorMessage); ok {
+    return err
+  }
+  return &Fault{"error", "Client.Authentication", err.Error(), ""}
+}
@@ -0,0 +1,180 @@
+package goamf
+
+import (
+  "io"
+  "bytes"
+  "strconv"
+)
+
+const (
+  // defaultMaxDepth bounds the nesting of values when no limit is set,
+  // before deep recursion could exhaust the stack.
+  defaultMaxDepth = 10000
+
+  // maxPrealloc bounds the memory reserved from a length read off the
+  // wire. Larger values grow as their content is actually read.
+  maxPrealloc = 4096
+)
+
+// DecodeLimits bound the resources a Decoder spends on its input. A zero
+// field means no limit, except that nesting is always limited to 10000
+// levels.
+type DecodeLimits struct {
+  // MaxDepth limits how deeply objects and arrays may nest.
+  MaxDepth int
+  // MaxStringLength limits the byte length of strings, XML and ByteArray
+  // contents.
+  MaxStringLength int
+  // MaxArrayLength limits the element count of arrays, vectors and
+  // dictionaries.
+  MaxArrayLength int
+  // MaxObjectMembers limits the property count of a single object,
+  // including the associative part of arrays.
+  MaxObjectMembers int
+  // MaxReferences limits each of the string, object and traits reference
+  // tables.
+  MaxReferences int
+  // MaxBytes limits the total number of bytes read from the input.
+  MaxBytes int64
+}
+
+// A LimitError reports input that exceeds one of the DecodeLimits. Limit
+// is the name of the DecodeLimits field.
+type LimitError struct {
+  Limit string
+  Value int64
+  Max int64
+}
+
+func (e *LimitError) Error() string {
+  return "AMF input exceeds " + e.Limit + ": " + strconv.FormatInt(e.Value, 10) + " > " + strconv.FormatInt(e.Max, 10)
+}
+
+func checkLimit(limit string, value int64, max int) error {
+  if max > 0 && value > int64(max) {
+    return &LimitError{limit, value, int64(max)}
+  }
+  return nil
+}
+
+// countingReader counts the bytes read through it and fails once more
+// than max bytes would be read.
+type countingReader struct {
+  r Reader
+  n int64
+  max int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+  if cr.max > 0 && cr.n + int64(len(p)) > cr.max {
+    if cr.n >= cr.max {
+      return 0, &LimitError{"MaxBytes", cr.n + int64(len(p)), cr.max}
+    }
+    p = p[:cr.max - cr.n]
+  }
+
+  n, err := cr.r.Read(p)
+  cr.n += int64(n)
+  return n, err
+}
+
+func (cr *countingReader) ReadByte() (byte, error) {
+  if cr.max > 0 && cr.n >= cr.max {
+    return 0, &LimitError{"MaxBytes", cr.n + 1, cr.max}
+  }
+
+  b, err := cr.r.ReadByte()
+  if err == nil {
+    cr.n++
+  }
+  return b, err
+}
+
+var noLimits DecodeLimits
+
+func (d *decodeState) limit() *DecodeLimits {
+  if d.limits == nil {
+    return &noLimits
+  }
+  return d.limits
+}
+
+func (d *decodeState) maxDepth() int {
+  if d.limits == nil || d.limits.MaxDepth <= 0 {
+    return defaultMaxDepth
+  }
+  return d.limits.MaxDepth
+}
+
+func (d *decodeState) checkString(length uint32) error {
+  return checkLimit("MaxStringLength", int64(length), d.limit().MaxStringLength)
+}
+
+func (d *decodeState) checkArray(length uint32) error {
+  return checkLimit("MaxArrayLength", int64(length), d.limit().MaxArrayLength)
+}
+
+func (d *decodeState) checkMembers(count int) error {
+  return checkLimit("MaxObjectMembers", int64(count), d.limit().MaxObjectMembers)
+}
+
+// readString reads a string of length bytes after checking the length.
+func (d *decodeState) readString(length uint32) (string, error) {
+  err := d.checkString(length)
+  if err != nil {
+    return "", err
+  }
+
+  data, err := d.readBytes(int64(length))
+  return string(data), err
+}
+
+// readBytes reads n bytes without reserving more memory up front than the
+// input turns out to hold.
+func (d *decodeState) readBytes(n int64) ([]byte, error) {
+  if n <= maxPrealloc {
+    data := make([]byte, n)
+    _, err := io.ReadFull(d, data)
+    return data, err
+  }
+
+  var buf bytes.Buffer
+  _, err := io.CopyN(&buf, d, n)
+  if err == io.EOF {
+    err = io.ErrUnexpectedEOF
+  }
+  return buf.Bytes(), err
+}
+
+func capHint(n uint32) int {
+  if n > maxPrealloc {
+    return maxPrealloc
+  }
+  return int(n)
+}
+
+// The reference tables are filled from deep inside the decoders, so an
+// exceeded MaxReferences panics with a LimitError, which unmarshal turns
+// into its error.
+
+func (d *decodeState) addStringRef(str string) {
+  d.checkReferences(len(d.stringRef))
+  d.refStore.addStringRef(str)
+}
+
+func (d *decodeState) addObjectRef(v interface{}) {
+  d.checkReferences(len(d.objectRef))
+  d.refStore.addObjectRef(v)
+}
+
+func (d *decodeState) addTraitsRef(traits *Traits) {
+  d.checkReferences(len(d.traitsRef))
+  d.refStore.addTraitsRef(traits)
+}
+
+func (d *decodeState) checkReferences(count int) {
+  err := checkLimit("MaxReferences", int64(count + 1), d.limit().MaxReferences)
+  if err != nil {
+    panic(err)
+  }
+}
@@ -0,0 +1,64 @@
+package goamf
+
+import (
+  "bytes"
+  "errors"
+  "strings"
+  "testing"
+)
+
+func TestDecodeLimits(t *testing.T) {
+  nested := []interface{}{[]interface{}{[]interface{}{"deep"}}}
+  obj := NewAMF0Object()
+  obj.AddValue("a", 1.0)
+  obj.AddValue("b", 2.0)
+
+  tests := []struct {
+    version uint16
+    v interface{}
+    limits DecodeLimits
+    limit string
+  }{
+    {AMF0, strings.Repeat("x", 100), DecodeLimits{MaxStringLength: 99}, "MaxStringLength"},
+    {AMF3, strings.Repeat("x", 100), DecodeLimits{MaxStringLength: 99}, "MaxStringLength"},
+    {AMF0, make([]interface{}, 10), DecodeLimits{MaxArrayLength: 9}, "MaxArrayLength"},
+    {AMF3, make([]interface{}, 10), DecodeLimits{MaxArrayLength: 9}, "MaxArrayLength"},
+    {AMF0, nested, DecodeLimits{MaxDepth: 3}, "MaxDepth"},
+    {AMF3, nested, DecodeLimits{MaxDepth: 3}, "MaxDepth"},
+    {AMF0, obj, DecodeLimits{MaxObjectMembers: 1}, "MaxObjectMembers"},
+    {AMF3, obj, DecodeLimits{MaxObjectMembers: 1}, "MaxObjectMembers"},
+    {AMF3, []string{"a", "b", "c"}, DecodeLimits{MaxReferences: 2}, "MaxReferences"},
+    {AMF0, strings.Repeat("x", 100), DecodeLimits{MaxBytes: 50}, "MaxBytes"},
+    {AMF3, strings.Repeat("x", 100), DecodeLimits{MaxBytes: 50}, "MaxBytes"},
+  }
+
+  for _, test := range tests {
+    data := mustMarshal(t, test.version, test.v)
+
+    dec := NewDecoder(bytes.NewReader(data), test.version)
+    dec.SetLimits(test.limits)
+    var v interface{}
+    err := dec.Decode(&v)
+    var le *LimitError
+    if !errors.As(err, &le) || le.Limit != test.limit {
+      t.Fatalf("AMF%d %s: got %v", test.version, test.limit, err)
+    }
+
+    dec = NewDecoder(bytes.NewReader(data), test.version)
+    dec.SetLimits(DecodeLimits{MaxDepth: 4, MaxStringLength: 100, MaxArrayLength: 10, MaxObjectMembers: 2, MaxReferences: 3, MaxBytes: int64(len(data))})
+    if err := dec.Decode(&v); err != nil {
+      t.Fatalf("AMF%d %s: input within the limits failed: %v", test.version, test.limit, err)
+    }
+  }
+}
+
+func TestDefaultMaxDepth(t *testing.T) {
+  data := bytes.Repeat([]byte{AMF3_ARRAY_MARKER, 0x03, 0x01}, defaultMaxDepth + 1)
+  data = append(data, AMF3_NULL_MARKER)
+
+  _, err := UnmarshalAmf3(data)
+  var le *LimitError
+  if !errors.As(err, &le) || le.Limit != "MaxDepth" {
+    t.Fatalf("Got %v", err)
+  }
+}
@@ -0,0 +1,604 @@
+package goamf
+
+import (
+  "time"
+  "errors"
+  "crypto/rand"
+  "encoding/hex"
+)
+
+// Operations of CommandMessage.
+const (
+  SUBSCRIBE_OPERATION               = 0
+  UNSUBSCRIBE_OPERATION             = 1
+  POLL_OPERATION                    = 2
+  CLIENT_SYNC_OPERATION             = 4
+  CLIENT_PING_OPERATION             = 5
+  CLUSTER_REQUEST_OPERATION         = 7
+  LOGIN_OPERATION                   = 8
+  LOGOUT_OPERATION                  = 9
+  SUBSCRIPTION_INVALIDATE_OPERATION = 10
+  MULTI_SUBSCRIBE_OPERATION         = 11
+  DISCONNECT_OPERATION              = 12
+  TRIGGER_CONNECT_OPERATION         = 13
+  UNKNOWN_OPERATION                 = 10000
+)
+
+// Flags of the externalized small messages. Every flags byte but the last
+// has hasNextFlag set.
+const (
+  hasNextFlag = 0x80
+
+  bodyFlag = 0x01
+  clientIdFlag = 0x02
+  destinationFlag = 0x04
+  headersFlag = 0x08
+  messageIdFlag = 0x10
+  timestampFlag = 0x20
+  timeToLiveFlag = 0x40
+  clientIdBytesFlag = 0x01
+  messageIdBytesFlag = 0x02
+
+  correlationIdFlag = 0x01
+  correlationIdBytesFlag = 0x02
+
+  operationFlag = 0x01
+)
+
+func init() {
+  RegisterClassAlias("flex.messaging.messages.RemotingMessage", RemotingMessage{})
+  RegisterClassAlias("flex.messaging.messages.AsyncMessage", AsyncMessage{})
+  RegisterClassAlias("flex.messaging.messages.AcknowledgeMessage", AcknowledgeMessage{})
+  RegisterClassAlias("flex.messaging.messages.ErrorMessage", ErrorMessage{})
+  RegisterClassAlias("flex.messaging.messages.CommandMessage", CommandMessage{})
+  RegisterClassAlias("DSA", AsyncMessageExt{})
+  RegisterClassAlias("DSK", AcknowledgeMessageExt{})
+  RegisterClassAlias("DSC", CommandMessageExt{})
+}
+
+// AbstractMessage holds the properties shared by all Flex messages, as in
+// flex.messaging.messages.AbstractMessage. Timestamp and TimeToLive are in
+// milliseconds.
+type AbstractMessage struct {
+  Body interface{} `amf:"body"`
+  ClientId string `amf:"clientId,omitempty"`
+  Destination string `amf:"destination"`
+  Headers map[string]interface{} `amf:"headers"`
+  MessageId string `amf:"messageId"`
+  Timestamp int64 `amf:"timestamp"`
+  TimeToLive int64 `amf:"timeToLive"`
+}
+
+// RemotingMessage invokes Operation of the remote service Destination with
+// the arguments in Body.
+type RemotingMessage struct {
+  AbstractMessage
+  Operation string `amf:"operation"`
+  Source string `amf:"source"`
+}
+
+// AsyncMessage is a message that may answer the message CorrelationId.
+type AsyncMessage struct {
+  AbstractMessage
+  CorrelationId string `amf:"correlationId"`
+}
+
+// AcknowledgeMessage carries the result of the message it correlates to.
+type AcknowledgeMessage struct {
+  AsyncMessage
+}
+
+// ErrorMessage reports the fault of the message it correlates to.
+type ErrorMessage struct {
+  AcknowledgeMessage
+  FaultCode string `amf:"faultCode"`
+  FaultString string `amf:"faultString"`
+  FaultDetail string `amf:"faultDetail"`
+  RootCause interface{} `amf:"rootCause"`
+  ExtendedData map[string]interface{} `amf:"extendedData"`
+}
+
+func (m *ErrorMessage) Error() string {
+  if m.FaultCode == "" {
+    return m.FaultString
+  }
+  return m.FaultCode + ": " + m.FaultString
+}
+
+// CommandMessage controls the messaging infrastructure, such as the ping
+// with which a Flex client connects to its channel.
+type CommandMessage struct {
+  AsyncMessage
+  Operation int `amf:"operation"`
+}
+
+// AsyncMessageExt, AcknowledgeMessageExt and CommandMessageExt are the
+// small forms DSA, DSK and DSC, which BlazeDS and Flex externalize with
+// flag bytes to save the traits and the nulls of the full messages. They
+// assign to their full message types.
+type AsyncMessageExt struct {
+  AsyncMessage
+}
+
+type AcknowledgeMessageExt struct {
+  AcknowledgeMessage
+}
+
+type CommandMessageExt struct {
+  CommandMessage
+}
+
+func (m *AsyncMessageExt) ReadExternal(in DataInput) error {
+  return m.readExternal(in)
+}
+
+func (m *AsyncMessageExt) WriteExternal(out DataOutput) error {
+  return m.writeExternal(out)
+}
+
+func (m *AcknowledgeMessageExt) ReadExternal(in DataInput) error {
+  return m.readExternal(in)
+}
+
+func (m *AcknowledgeMessageExt) WriteExternal(out DataOutput) error {
+  return m.writeExternal(out)
+}
+
+func (m *CommandMessageExt) ReadExternal(in DataInput) error {
+  return m.readExternal(in)
+}
+
+func (m *CommandMessageExt) WriteExternal(out DataOutput) error {
+  return m.writeExternal(out)
+}
+
+// smallMessage is implemented by the small forms, so that they can be
+// assigned to their full message types.
+type smallMessage interface {
+  fullMessage() interface{}
+}
+
+func (m *AsyncMessageExt) fullMessage() interface{} {
+  return &m.AsyncMessage
+}
+
+func (m *AcknowledgeMessageExt) fullMessage() interface{} {
+  return &m.AcknowledgeMessage
+}
+
+func (m *CommandMessageExt) fullMessage() interface{} {
+  return &m.CommandMessage
+}
+
+func (m *AbstractMessage) readExternal(in DataInput) error {
+  flags, err := readFlags(in)
+  if err != nil {
+    return err
+  }
+
+  for i, b := range flags {
+    reserved := uint(0)
+    switch i {
+    case 0:
+      if b & bodyFlag != 0 {
+        m.Body, err = in.ReadObject()
+      }
+      if err == nil && b & clientIdFlag != 0 {
+        m.ClientId, err = readStringObject(in)
+      }
+      if err == nil && b & destinationFlag != 0 {
+        m.Destination, err = readStringObject(in)
+      }
+      if err == nil && b & headersFlag != 0 {
+        m.Headers, err = readMapObject(in)
+      }
+      if err == nil && b & messageIdFlag != 0 {
+        m.MessageId, err = readStringObject(in)
+      }
+      if err == nil && b & timestampFlag != 0 {
+        m.Timestamp, err = readLongObject(in)
+      }
+      if err == nil && b & timeToLiveFlag != 0 {
+        m.TimeToLive, err = readLongObject(in)
+      }
+      reserved = 7
+    case 1:
+      if b & clientIdBytesFlag != 0 {
+        m.ClientId, err = readUUIDObject(in)
+      }
+      if err == nil && b & messageIdBytesFlag != 0 {
+        m.MessageId, err = readUUIDObject(in)
+      }
+      reserved = 2
+    }
+    if err == nil {
+      err = skipFlagged(in, b, reserved)
+    }
+    if err != nil {
+      return err
+    }
+  }
+  return nil
+}
+
+func (m *AbstractMessage) writeExternal(out DataOutput) error {
+  clientIdBytes := uuidBytes(m.ClientId)
+  messageIdBytes := uuidBytes(m.MessageId)
+
+  var flags, bytesFlags byte
+  if m.Body != nil {
+    flags |= bodyFlag
+  }
+  if m.ClientId != "" && clientIdBytes == nil {
+    flags |= clientIdFlag
+  }
+  if m.Destination != "" {
+    flags |= destinationFlag
+  }
+  if m.Headers != nil {
+    flags |= headersFlag
+  }
+  if m.MessageId != "" && messageIdBytes == nil {
+    flags |= messageIdFlag
+  }
+  if m.Timestamp != 0 {
+    flags |= timestampFlag
+  }
+  if m.TimeToLive != 0 {
+    flags |= timeToLiveFlag
+  }
+  if clientIdBytes != nil {
+    bytesFlags |= clientIdBytesFlag
+  }
+  if messageIdBytes != nil {
+    bytesFlags |= messageIdBytesFlag
+  }
+
+  err := writeFlags(out, flags, bytesFlags)
+  if err != nil {
+    return err
+  }
+
+  values := []interface{}{m.Body, m.ClientId, m.Destination, m.Headers, m.MessageId, float64(m.Timestamp), float64(m.TimeToLive)}
+  for i, v := range values {
+    if flags & (1 << uint(i)) == 0 {
+      continue
+    }
+    err = out.WriteObject(v)
+    if err != nil {
+      return err
+    }
+  }
+
+  for _, id := range [][]byte{clientIdBytes, messageIdBytes} {
+    if id == nil {
+      continue
+    }
+    err = out.WriteObject(id)
+    if err != nil {
+      return err
+    }
+  }
+  return nil
+}
+
+func (m *AsyncMessage) readExternal(in DataInput) error {
+  err := m.AbstractMessage.readExternal(in)
+  if err != nil {
+    return err
+  }
+
+  flags, err := readFlags(in)
+  if err != nil {
+    return err
+  }
+
+  for i, b := range flags {
+    reserved := uint(0)
+    if i == 0 {
+      if b & correlationIdFlag != 0 {
+        m.CorrelationId, err = readStringObject(in)
+      }
+      if err == nil && b & correlationIdBytesFlag != 0 {
+        m.CorrelationId, err = readUUIDObject(in)
+      }
+      reserved = 2
+    }
+    if err == nil {
+      err = skipFlagged(in, b, reserved)
+    }
+    if err != nil {
+      return err
+    }
+  }
+  return nil
+}
+
+func (m *AsyncMessage) writeExternal(out DataOutput) error {
+  err := m.AbstractMessage.writeExternal(out)
+  if err != nil {
+    return err
+  }
+
+  correlationIdBytes := uuidBytes(m.CorrelationId)
+  switch {
+  case correlationIdBytes != nil:
+    err = writeFlags(out, correlationIdBytesFlag)
+    if err == nil {
+      err = out.WriteObject(correlationIdBytes)
+    }
+  case m.CorrelationId != "":
+    err = writeFlags(out, correlationIdFlag)
+    if err == nil {
+      err = out.WriteObject(m.CorrelationId)
+    }
+  default:
+    err = writeFlags(out, 0)
+  }
+  return err
+}
+
+func (m *AcknowledgeMessage) readExternal(in DataInput) error {
+  err := m.AsyncMessage.readExternal(in)
+  if err != nil {
+    return err
+  }
+
+  flags, err := readFlags(in)
+  if err != nil {
+    return err
+  }
+
+  for _, b := range flags {
+    err = skipFlagged(in, b, 0)
+    if err != nil {
+      return err
+    }
+  }
+  return nil
+}
+
+func (m *AcknowledgeMessage) writeExternal(out DataOutput) error {
+  err := m.AsyncMessage.writeExternal(out)
+  if err != nil {
+    return err
+  }
+  return writeFlags(out, 0)
+}
+
+func (m *CommandMessage) readExternal(in DataInput) error {
+  err := m.AsyncMessage.readExternal(in)
+  if err != nil {
+    return err
+  }
+
+  flags, err := readFlags(in)
+  if err != nil {
+    return err
+  }
+
+  for i, b := range flags {
+    reserved := uint(0)
+    if i == 0 {
+      if b & operationFlag != 0 {
+        var n int64
+        n, err = readLongObject(in)
+        m.Operation = int(n)
+      }
+      reserved = 1
+    }
+    if err == nil {
+      err = skipFlagged(in, b, reserved)
+    }
+    if err != nil {
+      return err
+    }
+  }
+  return nil
+}
+
+func (m *CommandMessage) writeExternal(out DataOutput) error {
+  err := m.AsyncMessage.writeExternal(out)
+  if err != nil {
+    return err
+  }
+
+  if m.Operation == 0 {
+    return writeFlags(out, 0)
+  }
+  err = writeFlags(out, operationFlag)
+  if err != nil {
+    return err
+  }
+  return out.WriteObject(int32(m.Operation))
+}
+
+// NewRemotingMessage returns a message calling operation of destination
+// with args.
+func NewRemotingMessage(destination, operation string, args ...interface{}) *RemotingMessage {
+  if args == nil {
+    args = []interface{}{}
+  }
+
+  m := &RemotingMessage{Operation: operation}
+  m.Body = args
+  m.Destination = destination
+  m.Headers = map[string]interface{}{}
+  m.MessageId = NewMessageId()
+  return m
+}
+
+// NewAcknowledgeMessage returns the acknowledgement of the message
+// correlationId carrying the result body.
+func NewAcknowledgeMessage(correlationId string, body interface{}) *AcknowledgeMessage {
+  m := &AcknowledgeMessage{}
+  m.init(correlationId)
+  m.Body = body
+  return m
+}
+
+// NewErrorMessage returns the fault of the message correlationId.
+func NewErrorMessage(correlationId, faultCode, faultString string) *ErrorMessage {
+  m := &ErrorMessage{FaultCode: faultCode, FaultString: faultString}
+  m.init(correlationId)
+  return m
+}
+
+func (m *AsyncMessage) init(correlationId string) {
+  m.CorrelationId = correlationId
+  m.Headers = map[string]interface{}{}
+  m.MessageId = NewMessageId()
+  m.Timestamp = time.Now().UnixNano() / int64(time.Millisecond)
+}
+
+// NewMessageId returns a random UUID in the form Flex uses for message
+// and client ids.
+func NewMessageId() string {
+  var id [16]byte
+  _, err := rand.Read(id[:])
+  if err != nil {
+    panic("goamf: can not read random bytes: " + err.Error())
+  }
+  id[6] = id[6] & 0x0f | 0x40
+  id[8] = id[8] & 0x3f | 0x80
+  return uuidString(id[:])
+}
+
+func uuidString(id []byte) string {
+  buf := make([]byte, 36)
+  hex.Encode(buf[0:8], id[0:4])
+  buf[8] = '-'
+  hex.Encode(buf[9:13], id[4:6])
+  buf[13] = '-'
+  hex.Encode(buf[14:18], id[6:8])
+  buf[18] = '-'
+  hex.Encode(buf[19:23], id[8:10])
+  buf[23] = '-'
+  hex.Encode(buf[24:], id[10:])
+  for i, c := range buf {
+    if c >= 'a' && c <= 'f' {
+      buf[i] = c - 'a' + 'A'
+    }
+  }
+  return string(buf)
+}
+
+// uuidBytes returns the 16 bytes of the UUID str, or nil when str is not
+// a UUID and has to be written as a string.
+func uuidBytes(str string) []byte {
+  if len(str) != 36 || str[8] != '-' || str[13] != '-' || str[18] != '-' || str[23] != '-' {
+    return nil
+  }
+
+  id := make([]byte, 16)
+  n := 0
+  for _, part := range []string{str[0:8], str[9:13], str[14:18], str[19:23], str[24:]} {
+    m, err := hex.Decode(id[n:], []byte(part))
+    if err != nil {
+      return nil
+    }
+    n += m
+  }
+  return id
+}
+
+func readFlags(in DataInput) ([]byte, error) {
+  flags := []byte{}
+  for {
+    b, err := in.ReadUnsignedByte()
+    if err != nil {
+      return nil, err
+    }
+
+    flags = append(flags, b)
+    if b & hasNextFlag == 0 {
+      return flags, nil
+    }
+  }
+}
+
+func writeFlags(out DataOutput, flags ...byte) error {
+  for len(flags) > 1 && flags[len(flags)-1] == 0 {
+    flags = flags[:len(flags)-1]
+  }
+
+  for i, b := range flags {
+    if i < len(flags) - 1 {
+      b |= hasNextFlag
+    }
+    err := out.WriteByte(b)
+    if err != nil {
+      return err
+    }
+  }
+  return nil
+}
+
+// skipFlagged reads and drops the values flagged from bit reserved on,
+// which newer versions of a message may write.
+func skipFlagged(in DataInput, flags byte, reserved uint) error {
+  for bit := reserved; bit < 7; bit++ {
+    if flags >> bit & 1 == 0 {
+      continue
+    }
+    _, err := in.ReadObject()
+    if err != nil {
+      return err
+    }
+  }
+  return nil
+}
+
+func readStringObject(in DataInput) (string, error) {
+  v, err := in.ReadObject()
+  if err != nil {
+    return "", err
+  }
+
+  switch str := v.(type) {
+  case string:
+    return str, nil
+  case nil, Undefined:
+    return "", nil
+  }
+  return "", errors.New("Expected a string in the message but got " + describeValue(v))
+}
+
+func readUUIDObject(in DataInput) (string, error) {
+  v, err := in.ReadObject()
+  if err != nil {
+    return "", err
+  }
+
+  ba, ok := v.(*ByteArray)
+  if !ok || ba.Len() != 16 {
+    return "", errors.New("Expected the 16 bytes of a UUID in the message but got " + describeValue(v))
+  }
+  return uuidString(ba.Bytes()), nil
+}
+
+func readLongObject(in DataInput) (int64, error) {
+  v, err := in.ReadObject()
+  if err != nil {
+    return 0, err
+  }
+
+  f, ok := numberValue(v)
+  if !ok {
+    return 0, errors.New("Expected a number in the message but got " + describeValue(v))
+  }
+  return int64(f), nil
+}
+
+func readMapObject(in DataInput) (map[string]interface{}, error) {
+  v, err := in.ReadObject()
+  if err != nil || v == nil {
+    return nil, err
+  }
+
+  values, ok := objectValues(v)
+  if !ok {
+    return nil, errors.New("Expected an object in the message but got " + describeValue(v))
+  }
+  return values, nil
+}
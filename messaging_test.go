@@ -0,0 +1,94 @@
+package goamf
+
+import (
+  "bytes"
+  "testing"
+)
+
+func TestSmallMessages(t *testing.T) {
+  ack := NewAcknowledgeMessage(NewMessageId(), map[string]interface{}{"x": 1.0})
+  ack.ClientId = "not-a-uuid"
+  async := &AsyncMessage{CorrelationId: "cid"}
+  async.MessageId = NewMessageId()
+  async.Headers = map[string]interface{}{"DSId": "abc"}
+  cmd := &CommandMessage{Operation: 5}
+  cmd.MessageId = NewMessageId()
+
+  tests := []struct {
+    v interface{}
+    alias string
+    full interface{}
+  }{
+    {&AcknowledgeMessageExt{*ack}, "DSK", &AcknowledgeMessage{}},
+    {&AsyncMessageExt{*async}, "DSA", &AsyncMessage{}},
+    {&CommandMessageExt{*cmd}, "DSC", &CommandMessage{}},
+  }
+
+  for _, test := range tests {
+    data := mustMarshal(t, AMF3, test.v)
+    if !bytes.Contains(data, []byte(test.alias)) {
+      t.Fatalf("%T encoded as % x", test.v, data)
+    }
+
+    v, err := UnmarshalAmf3(data)
+    if err != nil {
+      t.Fatal(err)
+    }
+    if !bytes.Equal(mustMarshal(t, AMF3, v), data) {
+      t.Fatalf("%s did not survive a round trip: %#v", test.alias, v)
+    }
+
+    // The small forms assign to their full message types.
+    if err := Unmarshal(append([]byte{AMF0_ACMPLUS_OBJECT_MARKER}, data...), test.full); err != nil {
+      t.Fatalf("%s: %v", test.alias, err)
+    }
+  }
+
+  var full AcknowledgeMessage
+  Unmarshal(append([]byte{AMF0_ACMPLUS_OBJECT_MARKER}, mustMarshal(t, AMF3, tests[0].v)...), &full)
+  if full.MessageId != ack.MessageId || full.CorrelationId != ack.CorrelationId || full.ClientId != "not-a-uuid" || full.Timestamp != ack.Timestamp {
+    t.Fatalf("Got %+v, want %+v", full, ack)
+  }
+}
+
+func TestHandWrittenDSA(t *testing.T) {
+  id := "0A1B2C3D-1111-4222-8333-444455556666"
+  if uuidString(uuidBytes(id)) != id {
+    t.Fatalf("Got %s", uuidString(uuidBytes(id)))
+  }
+
+  // Two bytes of flags, the second one only with messageIdBytes, then the
+  // 16 bytes of the id and one byte of flags with correlationId.
+  data := []byte{AMF3_OBJECT_MARKER, 0x07, 0x07, 'D', 'S', 'A', 0x80, 0x02, AMF3_BYTEARRAY_MARKER, 0x21}
+  data = append(data, uuidBytes(id)...)
+  data = append(data, 0x01, AMF3_STRING_MARKER, 0x07, 'c', 'i', 'd')
+
+  v, err := UnmarshalAmf3(data)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if m := v.(*AsyncMessageExt); m.MessageId != id || m.CorrelationId != "cid" {
+    t.Fatalf("Got %+v", m)
+  }
+}
+
+func TestFullMessages(t *testing.T) {
+  rm := NewRemotingMessage("UserService", "getUser", 1.0, "a")
+  v, err := UnmarshalAmf3(mustMarshal(t, AMF3, rm))
+  if err != nil {
+    t.Fatal(err)
+  }
+  got := v.(*RemotingMessage)
+  if got.Operation != "getUser" || got.Destination != "UserService" || got.MessageId != rm.MessageId || len(got.Body.(*AMF3Array).DenseValues) != 2 {
+    t.Fatalf("Got %#v", got)
+  }
+
+  em := NewErrorMessage(rm.MessageId, "Server.Error", "boom")
+  v, err = UnmarshalAmf3(mustMarshal(t, AMF3, em))
+  if err != nil {
+    t.Fatal(err)
+  }
+  if e := v.(*ErrorMessage); e.Error() != "Server.Error: boom" || e.CorrelationId != rm.MessageId {
+    t.Fatalf("Got %#v", e)
+  }
+}
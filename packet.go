@@ -6,7 +6,7 @@ import (
 
 func NewAmfPacket(version uint16) (*Packet, error) {
   if version != AMF0 && version != AMF3 {
-    return nil, errors.New("AMF version must be 0 or 3 version")
+    return nil, ErrUnsupportedVersion
   }
   
   return &Packet{version, make([]PacketHeader, 0), make([]PacketMessage, 0)}, nil
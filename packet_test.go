@@ -0,0 +1,141 @@
+package goamf
+
+import (
+  "bytes"
+  "reflect"
+  "testing"
+)
+
+func TestPacketLayout(t *testing.T) {
+  p, err := NewAmfPacket(AMF3)
+  if err != nil {
+    t.Fatal(err)
+  }
+  p.AddMessage("a.b", "/1", []interface{}{"x"})
+
+  data, err := MarshalPacket(p)
+  if err != nil {
+    t.Fatal(err)
+  }
+  want := mustHex(t, "0003" + "0000" + "0001" + "0003612e62" + "00022f31" + "00000009" + "0a00000001" + "11060378")
+  if !bytes.Equal(data, want) {
+    t.Fatalf("Got % x, want % x", data, want)
+  }
+
+  got, err := UnmarshalPacket(data)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if got.Version != AMF3 || got.Messages[0].TargetUri != "a.b" || !reflect.DeepEqual(got.Messages[0].Value, []interface{}{"x"}) {
+    t.Fatalf("Got %#v", got)
+  }
+
+  if _, err := NewAmfPacket(2); err != ErrUnsupportedVersion {
+    t.Fatalf("Got %v", err)
+  }
+  if _, err := UnmarshalPacket(mustHex(t, "000200000000")); err == nil {
+    t.Fatal("A packet of version 2 decoded")
+  }
+}
+
+func TestPacketRoundTrip(t *testing.T) {
+  for _, version := range versions {
+    p, err := NewAmfPacket(version)
+    if err != nil {
+      t.Fatal(err)
+    }
+    p.AddHeader("Credentials", 1, &Credentials{"u", "p"})
+    p.AddMessage("Svc.op", "/1", []interface{}{1.5, "s", []interface{}{true}})
+    p.AddMessage("Svc.op", "/2", nil)
+
+    got, err := UnmarshalPacket(mustPacket(t, p))
+    if err != nil {
+      t.Fatal(err)
+    }
+    if len(got.Headers) != 1 || got.Headers[0].HeaderName != "Credentials" || got.Headers[0].MustUnderstand != 1 {
+      t.Fatalf("AMF%d got headers %#v", version, got.Headers)
+    }
+    var cred Credentials
+    if err := (&Result{got.Headers[0].Value, version}).Decode(&cred); err != nil || cred.Userid != "u" {
+      t.Fatalf("AMF%d got credentials %#v, %v", version, cred, err)
+    }
+
+    var args []interface{}
+    if err := (&Result{got.Messages[0].Value, version}).Decode(&args); err != nil {
+      t.Fatal(err)
+    }
+    var flags []bool
+    if len(args) != 3 || args[0] != 1.5 || args[1] != "s" || (&Result{args[2], version}).Decode(&flags) != nil || !reflect.DeepEqual(flags, []bool{true}) {
+      t.Fatalf("AMF%d got %#v", version, args)
+    }
+    if got.Messages[1].ResponseUri != "/2" || got.Messages[1].Value != nil {
+      t.Fatalf("AMF%d got %#v", version, got.Messages[1])
+    }
+  }
+}
+
+func mustPacket(t *testing.T, p *Packet) []byte {
+  data, err := MarshalPacket(p)
+  if err != nil {
+    t.Fatal(err)
+  }
+  return data
+}
+
+func TestPacketReferenceTables(t *testing.T) {
+  p, _ := NewAmfPacket(AMF3)
+  p.AddMessage("a", "/1", []interface{}{"hello", "hello"})
+  p.AddMessage("a", "/2", []interface{}{"hello"})
+
+  data := mustPacket(t, p)
+  if n := bytes.Count(data, []byte("hello")); n != 2 {
+    t.Fatalf("The string was written %d times: % x", n, data)
+  }
+
+  got, err := UnmarshalPacket(data)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if !reflect.DeepEqual(got.Messages[0].Value, []interface{}{"hello", "hello"}) || !reflect.DeepEqual(got.Messages[1].Value, []interface{}{"hello"}) {
+    t.Fatalf("Got %#v", got.Messages)
+  }
+}
+
+func TestPacketUnknownLength(t *testing.T) {
+  p, _ := NewAmfPacket(AMF0)
+  p.AddMessage("a", "/1", []interface{}{"x", 2.0})
+  p.AddMessage("a", "/2", "y")
+
+  var buf bytes.Buffer
+  enc := NewEncoder(&buf, AMF0)
+  enc.SetUnknownPacketLengths(true)
+  if err := enc.Encode(p); err != nil {
+    t.Fatal(err)
+  }
+  if !bytes.Contains(buf.Bytes(), []byte{0xff, 0xff, 0xff, 0xff}) {
+    t.Fatalf("Got % x", buf.Bytes())
+  }
+
+  got, err := NewDecoder(&buf, AMF0).DecodePacket()
+  if err != nil {
+    t.Fatal(err)
+  }
+  if len(got.Messages) != 2 || got.Messages[1].Value != "y" {
+    t.Fatalf("Got %#v", got.Messages)
+  }
+}
+
+func TestPacketDecodeErrorPath(t *testing.T) {
+  p, _ := NewAmfPacket(AMF0)
+  p.AddMessage("a", "/1", "ok")
+  p.AddMessage("a", "/2", []interface{}{1.0, "x"})
+
+  data := mustPacket(t, p)
+  data[len(data) - 4] = 0xff
+
+  _, err := UnmarshalPacket(data)
+  de, ok := err.(*DecodeError)
+  if !ok || de.Path != "messages[1].body[1]" {
+    t.Fatalf("Got %v", err)
+  }
+}
@@ -2,78 +2,123 @@ package goamf
 
 import (
   "errors"
+  "reflect"
+  "strconv"
 )
 
+const (
+  stringRefSize = 32
+  objectRefSize = 32
+  traitsRefSize = 8
+)
+
+// refStore holds the string, object and traits reference tables of one
+// AMF3 stream. Decoding only appends and reads by index. Encoding looks
+// values up, so the first lookup builds a map index of the table, which
+// is then kept up to date by later additions.
 type refStore struct {
   stringRef []string
   objectRef []interface{}
-  traitsRef []*AMF3Object
+  traitsRef []*Traits
+
+  stringIndex map[string]uint32
+  objectIndex map[interface{}]uint32
+  traitsIndex map[traitsKey]uint32
+}
+
+// traitsKey is the signature under which traits are shared: objects with
+// the same class name, kind and sealed members use the same traits.
+type traitsKey struct {
+  className string
+  dynamic bool
+  external bool
+  members string
+}
+
+func newRefStore() *refStore {
+  return &refStore{
+    stringRef: make([]string, 0, stringRefSize),
+    objectRef: make([]interface{}, 0, objectRefSize),
+    traitsRef: make([]*Traits, 0, traitsRefSize),
+  }
 }
 
 func (ref *refStore) addStringRef(str string) {
   if ref == nil {
     return
   }
-  
-  if ref.stringRef == nil {
-    ref.stringRef = make([]string, 0, 1)
+
+  if ref.stringIndex != nil {
+    if _, ok := ref.stringIndex[str]; !ok {
+      ref.stringIndex[str] = uint32(len(ref.stringRef))
+    }
   }
   ref.stringRef = append(ref.stringRef, str)
 }
 
 func (ref *refStore) findStringRef(str string) (uint32, bool) {
-  if ref == nil || ref.stringRef == nil {
+  if ref == nil || len(ref.stringRef) == 0 {
     return 0, false
   }
-  
-  stringRef := ref.stringRef
-  length := uint32(len(stringRef))
-  for index := uint32(0); index < length; index++ {
-    if str == stringRef[index] {
-      return index, true
+
+  if ref.stringIndex == nil {
+    ref.stringIndex = make(map[string]uint32, cap(ref.stringRef))
+    for index := len(ref.stringRef) - 1; index >= 0; index-- {
+      ref.stringIndex[ref.stringRef[index]] = uint32(index)
     }
   }
-  
-  return 0, false
+
+  index, ok := ref.stringIndex[str]
+  return index, ok
 }
 
 func (ref *refStore) getStringRef(index uint32) (string, error) {
   if ref == nil {
     return "", errors.New("Ref store is nil")
   }
-  
+
   if index >= uint32(len(ref.stringRef)) {
-    return "", errors.New("The index of string ref is out of range")
+    return "", referenceError("string")
   }
-  
+
   return ref.stringRef[index], nil
 }
 
+// hashable reports whether v can be used as an object index key. Decoded
+// maps and slices take a slot in the table but are never looked up.
+func hashable(v interface{}) bool {
+  return v != nil && reflect.TypeOf(v).Comparable()
+}
+
 func (ref *refStore) addObjectRef(v interface{}) {
   if ref == nil {
     return
   }
-  
-  if ref.objectRef == nil {
-    ref.objectRef = make([]interface{}, 0, 1)
+
+  if ref.objectIndex != nil && hashable(v) {
+    if _, ok := ref.objectIndex[v]; !ok {
+      ref.objectIndex[v] = uint32(len(ref.objectRef))
+    }
   }
   ref.objectRef = append(ref.objectRef, v)
 }
 
 func (ref *refStore) findObjectRef(v interface{}) (uint32, bool) {
-  if ref == nil || ref.objectRef == nil {
+  if ref == nil || len(ref.objectRef) == 0 || !hashable(v) {
     return 0, false
   }
-  
-  objectRef := ref.objectRef
-  length := uint32(len(objectRef))
-  for index := uint32(0); index < length; index++ {
-    if v == objectRef[index] {
-      return index, true
+
+  if ref.objectIndex == nil {
+    ref.objectIndex = make(map[interface{}]uint32, cap(ref.objectRef))
+    for index := len(ref.objectRef) - 1; index >= 0; index-- {
+      if obj := ref.objectRef[index]; hashable(obj) {
+        ref.objectIndex[obj] = uint32(index)
+      }
     }
   }
-  
-  return 0, false
+
+  index, ok := ref.objectIndex[v]
+  return index, ok
 }
 
 func (ref *refStore) getObjectRef(index uint32) (interface{}, error) {
@@ -81,54 +126,59 @@ func (ref *refStore) getObjectRef(index uint32) (interface{}, error) {
     return "", errors.New("Ref store is nil")
   }
   if index >= uint32(len(ref.objectRef)) {
-    return "", errors.New("The index of object ref is out of range")
+    return "", referenceError("object")
   }
-  
+
   return ref.objectRef[index], nil
 }
 
-func (ref *refStore) addTraitsRef(obj *AMF3Object) {
+func newTraitsKey(traits *Traits) traitsKey {
+  members := make([]byte, 0, len(traits.Members) * 8)
+  for _, k := range traits.Members {
+    members = strconv.AppendInt(members, int64(len(k)), 10)
+    members = append(members, ':')
+    members = append(members, k...)
+  }
+  return traitsKey{traits.ClassName, traits.Dynamic, traits.Externalizable, string(members)}
+}
+
+func (ref *refStore) addTraitsRef(traits *Traits) {
   if ref == nil {
+    return
   }
-  
-  if ref.traitsRef == nil {
-    ref.traitsRef = make([]*AMF3Object, 0, 1)
+
+  if ref.traitsIndex != nil {
+    key := newTraitsKey(traits)
+    if _, ok := ref.traitsIndex[key]; !ok {
+      ref.traitsIndex[key] = uint32(len(ref.traitsRef))
+    }
   }
-  ref.traitsRef = append(ref.traitsRef, obj)
+  ref.traitsRef = append(ref.traitsRef, traits)
 }
 
-func (ref *refStore) findTraitsRef(obj *AMF3Object) (uint32, bool) {
-  if ref == nil || ref.traitsRef == nil {
+func (ref *refStore) findTraitsRef(traits *Traits) (uint32, bool) {
+  if ref == nil || len(ref.traitsRef) == 0 {
     return 0, false
   }
-  
-  traitsRef := ref.traitsRef
-  length := uint32(len(traitsRef))
-  for index := uint32(0); index < length; index++ {
-    if obj == traitsRef[index] {
-      return index, true
+
+  if ref.traitsIndex == nil {
+    ref.traitsIndex = make(map[traitsKey]uint32, cap(ref.traitsRef))
+    for index := len(ref.traitsRef) - 1; index >= 0; index-- {
+      ref.traitsIndex[newTraitsKey(ref.traitsRef[index])] = uint32(index)
     }
   }
-  
-  return 0, false
+
+  index, ok := ref.traitsIndex[newTraitsKey(traits)]
+  return index, ok
 }
 
-func (ref *refStore) getTraitsRef(index uint32) (*AMF3Object, error) {
+func (ref *refStore) getTraitsRef(index uint32) (*Traits, error) {
   if ref == nil {
     return nil, errors.New("Ref store is nil")
   }
   if index >= uint32(len(ref.traitsRef)) {
-    return nil, errors.New("The index of traits ref is out of range")
-  }
-
-  obj := ref.traitsRef[index]
-  return &AMF3Object{
-    obj.ClassName,
-    obj.Dyn,
-    obj.keys,
-    make(map[string]interface{}, len(obj.keys)),
-    make(map[string]interface{}),
-    true,
-    uint32(index),
-  }, nil
+    return nil, referenceError("traits")
+  }
+
+  return ref.traitsRef[index], nil
 }
@@ -0,0 +1,54 @@
+package goamf
+
+import (
+  "strconv"
+  "testing"
+)
+
+func TestRefStore(t *testing.T) {
+  ref := newRefStore()
+  ref.addStringRef("a")
+  ref.addStringRef("b")
+  if i, ok := ref.findStringRef("b"); !ok || i != 1 {
+    t.Fatalf("Got %d, %v", i, ok)
+  }
+  if _, err := ref.getStringRef(2); err == nil {
+    t.Fatal("Got a string past the table")
+  }
+
+  ref.addTraitsRef(&Traits{ClassName: "a", Members: []string{"x", "y"}})
+  ref.addTraitsRef(&Traits{ClassName: "a", Members: []string{"xy"}})
+  if i, ok := ref.findTraitsRef(&Traits{ClassName: "a", Members: []string{"xy"}}); !ok || i != 1 {
+    t.Fatalf("Got %d, %v", i, ok)
+  }
+
+  // Values that can not be map keys are kept but never found.
+  ref.addObjectRef(map[string]interface{}{})
+  ref.addObjectRef("s")
+  ref.addObjectRef("s")
+  ref.addObjectRef("t")
+  if i, ok := ref.findObjectRef("s"); !ok || i != 1 {
+    t.Fatalf("Got %d, %v", i, ok)
+  }
+  if i, ok := ref.findObjectRef("t"); !ok || i != 3 {
+    t.Fatalf("Got %d, %v", i, ok)
+  }
+}
+
+func TestManyReferences(t *testing.T) {
+  type row struct {
+    Name string
+    N int
+  }
+
+  rows := make([]row, 20000)
+  for i := range rows {
+    rows[i] = row{"name" + strconv.Itoa(i % 1000), i}
+  }
+
+  var out []row
+  roundTrip(t, AMF3, rows, &out)
+  if len(out) != len(rows) || out[1234] != rows[1234] {
+    t.Fatalf("Got %v", out[1234])
+  }
+}
@@ -0,0 +1,254 @@
+package goamf
+
+import (
+  "errors"
+  "strconv"
+  "reflect"
+  "runtime"
+  "context"
+  "net/http"
+  "unicode"
+  "unicode/utf8"
+)
+
+var (
+  contextType = reflect.TypeOf(new(context.Context)).Elem()
+  errorType = reflect.TypeOf(new(error)).Elem()
+)
+
+// callInfo is what the gateway knows about the packet of a call.
+type callInfo struct {
+  request *http.Request
+  headers []PacketHeader
+  version uint16
+  fault error
+  responseHeaders []PacketHeader
+}
+
+type callInfoKey struct{}
+
+func withCallInfo(ctx context.Context, info *callInfo) context.Context {
+  return context.WithValue(ctx, callInfoKey{}, info)
+}
+
+func contextCallInfo(ctx context.Context) *callInfo {
+  info, _ := ctx.Value(callInfoKey{}).(*callInfo)
+  if info == nil {
+    return &callInfo{}
+  }
+  return info
+}
+
+// RequestFromContext returns the HTTP request of the remoting call that
+// ctx belongs to.
+func RequestFromContext(ctx context.Context) (*http.Request, bool) {
+  r := contextCallInfo(ctx).request
+  return r, r != nil
+}
+
+// HeadersFromContext returns the headers of the packet of the remoting
+// call that ctx belongs to.
+func HeadersFromContext(ctx context.Context) []PacketHeader {
+  return contextCallInfo(ctx).headers
+}
+
+// HeaderFromContext returns the value of the packet header name.
+func HeaderFromContext(ctx context.Context, name string) (interface{}, bool) {
+  for _, header := range HeadersFromContext(ctx) {
+    if header.HeaderName == name {
+      return header.Value, true
+    }
+  }
+  return nil, false
+}
+
+// Register exposes the exported methods of svc as the remoting operations
+// of the service name. An operation is named like its method with the
+// first letter in lower case, so the method GetUser of "UserService" is
+// called as "UserService.getUser".
+//
+// The arguments of a call are converted to the parameter types of the
+// method as Decode does. A method may take a context.Context as its first
+// parameter, which carries the HTTP request and the packet headers, see
+// RequestFromContext and HeadersFromContext. It may return nothing, a
+// result, an error or a result and an error. A non-nil error is sent back
+// as the fault of the call.
+//
+// Like net/rpc, methods of other signatures are left out. So are methods
+// that svc only promotes from an embedded field, such as Lock of an
+// embedded sync.Mutex. Methods that svc declares itself are exposed, also
+// when they override those of an embedded field.
+func (g *Gateway) Register(name string, svc interface{}) error {
+  if name == "" || svc == nil {
+    return errors.New("Register needs a service name and a service")
+  }
+
+  v := reflect.ValueOf(svc)
+  promoted := promotedMethods(v.Type())
+  handlers := make(map[string]RemotingFunc)
+  for i := 0; i < v.NumMethod(); i++ {
+    m := v.Type().Method(i)
+    if m.PkgPath != "" || promoted[m.Name] {
+      continue
+    }
+
+    f, err := newMethodFunc(v.Method(i))
+    if err != nil {
+      continue
+    }
+    handlers[name + "." + operationName(m.Name)] = f
+  }
+  if len(handlers) == 0 {
+    return errors.New("Service " + name + " has no methods that can be exposed")
+  }
+
+  g.mu.Lock()
+  defer g.mu.Unlock()
+  for target, f := range handlers {
+    g.handlers[target] = f
+  }
+  return nil
+}
+
+// promotedMethods returns the names of the methods that the embedded
+// fields of the struct t, or of the struct t points to, provide and that
+// the struct does not declare itself.
+func promotedMethods(t reflect.Type) map[string]bool {
+  names := make(map[string]bool)
+  if t.Kind() == reflect.Ptr {
+    t = t.Elem()
+  }
+  if t.Kind() != reflect.Struct {
+    return names
+  }
+
+  for i := 0; i < t.NumField(); i++ {
+    f := t.Field(i)
+    if !f.Anonymous {
+      continue
+    }
+
+    for _, ft := range []reflect.Type{f.Type, reflect.PtrTo(f.Type)} {
+      for j := 0; j < ft.NumMethod(); j++ {
+        if name := ft.Method(j).Name; !declaresMethod(t, name) {
+          names[name] = true
+        }
+      }
+    }
+  }
+  return names
+}
+
+// declaresMethod reports whether the struct t declares the method name
+// on itself or on its pointer. The compiler generates the methods that a
+// struct promotes, and those of a pointer that call a value method, so
+// only a declared method has a source file.
+func declaresMethod(t reflect.Type, name string) bool {
+  for _, mt := range []reflect.Type{t, reflect.PtrTo(t)} {
+    m, ok := mt.MethodByName(name)
+    if !ok {
+      continue
+    }
+
+    f := runtime.FuncForPC(m.Func.Pointer())
+    if f == nil {
+      continue
+    }
+    if file, _ := f.FileLine(f.Entry()); file != "<autogenerated>" {
+      return true
+    }
+  }
+  return false
+}
+
+func operationName(method string) string {
+  r, n := utf8.DecodeRuneInString(method)
+  return string(unicode.ToLower(r)) + method[n:]
+}
+
+// newMethodFunc wraps the method fn into a RemotingFunc.
+func newMethodFunc(fn reflect.Value) (RemotingFunc, error) {
+  t := fn.Type()
+  in := make([]reflect.Type, t.NumIn())
+  for i := range in {
+    in[i] = t.In(i)
+  }
+
+  withContext := len(in) > 0 && in[0] == contextType
+  if withContext {
+    in = in[1:]
+  }
+
+  switch {
+  case t.NumOut() > 2:
+    return nil, errors.New("It returns more than a result and an error")
+  case t.NumOut() == 2 && t.Out(1) != errorType:
+    return nil, errors.New("Its second result is not an error")
+  }
+  errorOut := t.NumOut() > 0 && t.Out(t.NumOut() - 1) == errorType
+
+  return func(ctx context.Context, args []interface{}) (interface{}, error) {
+    values, err := methodArgs(in, t.IsVariadic(), args, contextCallInfo(ctx).version)
+    if err != nil {
+      return nil, err
+    }
+    if withContext {
+      values = append([]reflect.Value{reflect.ValueOf(&ctx).Elem()}, values...)
+    }
+
+    var out []reflect.Value
+    if t.IsVariadic() {
+      out = fn.CallSlice(values)
+    } else {
+      out = fn.Call(values)
+    }
+
+    if errorOut {
+      if e := out[len(out) - 1]; !e.IsNil() {
+        return nil, e.Interface().(error)
+      }
+      out = out[:len(out) - 1]
+    }
+    if len(out) == 0 {
+      return nil, nil
+    }
+    return out[0].Interface(), nil
+  }, nil
+}
+
+// methodArgs converts the call arguments to the parameter types in. The
+// arguments left over for a variadic parameter are gathered in a slice.
+func methodArgs(in []reflect.Type, variadic bool, args []interface{}, version uint16) ([]reflect.Value, error) {
+  fixed := len(in)
+  if variadic {
+    fixed--
+  }
+  if len(args) < fixed || (!variadic && len(args) > fixed) {
+    return nil, &Fault{"error", "Server.Processing", "Expected " + strconv.Itoa(fixed) + " arguments but got " + strconv.Itoa(len(args)), ""}
+  }
+
+  values := make([]reflect.Value, len(in))
+  for i := 0; i < fixed; i++ {
+    values[i] = reflect.New(in[i]).Elem()
+    err := assignValue(values[i], args[i], version)
+    if err != nil {
+      return nil, argumentFault(i, err)
+    }
+  }
+
+  if variadic {
+    rest := args[fixed:]
+    values[fixed] = reflect.MakeSlice(in[fixed], len(rest), len(rest))
+    for i, arg := range rest {
+      err := assignValue(values[fixed].Index(i), arg, version)
+      if err != nil {
+        return nil, argumentFault(fixed + i, err)
+      }
+    }
+  }
+  return values, nil
+}
+
+func argumentFault(i int, err error) error {
+  return &Fault{"error", "Server.Processing", "Bad argument " + strconv.Itoa(i) + ": " + err.Error(), ""}
+}
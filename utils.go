@@ -1,7 +1,10 @@
 package goamf
 
 import (
+  "math"
+  "time"
   "errors"
+  "reflect"
   "encoding/binary"
 )
 
@@ -43,6 +46,27 @@ func readDouble(r Reader) (num float64, err error) {
   return
 }
 
+func readDate(r Reader) (time.Time, error) {
+  ms, err := readDouble(r)
+  if err != nil {
+    return time.Time{}, err
+  }
+
+  // The time zone is reserved and should be 0x0000
+  _, err = readU16(r)
+  return msToTime(ms), err
+}
+
+func msToTime(ms float64) time.Time {
+  sec := math.Floor(ms / 1000)
+  nsec := (ms - sec * 1000) * 1e6
+  return time.Unix(int64(sec), int64(nsec)).UTC()
+}
+
+func timeToMs(t time.Time) float64 {
+  return float64(t.Unix()) * 1000 + float64(t.Nanosecond() / 1e6)
+}
+
 func readBoolean(r Reader) (bool, error) {
   b, err := r.ReadByte()
   if err != nil {
@@ -52,56 +76,24 @@ func readBoolean(r Reader) (bool, error) {
   return b != 0x00, err
 }
 
-func readUTF8(r Reader) (string, error) {
-  var length uint16
-  err := binary.Read(r, binary.BigEndian, &length)
-  if err != nil {
-    return "", err
-  } else if length == 0 {
-    return "", nil
-  }
-  
-  data := make([]byte, length)
-  _, err = r.Read(data)
-  if err != nil {
+func readUTF8(d *decodeState) (string, error) {
+  length, err := readU16(d)
+  if err != nil || length == 0 {
     return "", err
   }
-  return string(data), nil
+  return d.readString(uint32(length))
 }
 
-func readLongUTF8(r Reader) (string, error) {
-  var length uint32
-  err := binary.Read(r, binary.BigEndian, &length)
-  if err != nil {
+func readLongUTF8(d *decodeState) (string, error) {
+  length, err := readU32(d)
+  if err != nil || length == 0 {
     return "", err
-  } else if length == 0 {
-    return "", nil
-  }
-  
-  data := make([]byte, length)
-  _, err = r.Read(data)
-  if err != nil {
-    return "", err
-  }
-  return string(data), nil
-}
-
-func readStrictArray(r Reader) ([]interface{}, error) {
-  var count uint32
-  err := binary.Read(r, binary.BigEndian, &count)
-  if err != nil {
-    return nil, err
-  }
-
-  arr := make([]interface{}, 0, count)
-  for i := uint32(0); i < count; i++ {
   }
-  
-  return arr, nil
+  return d.readString(length)
 }
 
-func readObjectProperty(d *decodeState, values map[string]interface{}) error {
-  for {
+func readObjectProperty(d *decodeState, add func(k string, v interface{})) error {
+  for count := 1; ; count++ {
     k, err := readUTF8(d)
     if err != nil {
       return err
@@ -112,21 +104,25 @@ func readObjectProperty(d *decodeState, values map[string]interface{}) error {
       if mark == byte(AMF0_OBJECT_END_MARKER) {
         return nil
       } else if err == nil {
-        err = errors.New("Can not find AMF0_OBJECT_END_MARKER")
+        err = formatError("Can not find AMF0_OBJECT_END_MARKER")
       }
       
       if err != nil {
         return err
       }
     }
+
+    err = d.checkMembers(count)
+    if err != nil {
+      return err
+    }
     
     v, err := d.unmarshal()
     if err != nil {
-      return err
+      return keyPath(err, k)
     }
-    values[k] = v
+    add(k, v)
   }
-  return nil
 }
 
 //
@@ -148,6 +144,19 @@ func writeDouble(w Writer, num float64) (n int, err error) {
   return 9, nil
 }
 
+func writeDate(w Writer, t time.Time) error {
+  err := w.WriteByte(AMF0_DATE_MARKER)
+  if err != nil {
+    return err
+  }
+
+  err = binary.Write(w, binary.BigEndian, timeToMs(t))
+  if err != nil {
+    return err
+  }
+  return writeU16(w, 0x0000)
+}
+
 func writeBoolean(w Writer, b bool) (n int, err error) {
   err = w.WriteByte(AMF0_BOOLEAN_MARKER)
   if err != nil {
@@ -213,23 +222,78 @@ func writeAMF0EmptyUTF8(w Writer) error {
   return binary.Write(w, binary.BigEndian, &data)
 }
 
-func writeStrictArray(e *encodeState, arr []interface{}) error {
+// errEmptyName is returned for an object property or associative array
+// member named by the empty string, which would end the members early.
+var errEmptyName = errors.New("The empty string can not be a property name")
+
+func writeObjectEnd(w Writer) error {
+  err := writeAMF0EmptyUTF8(w)
+  if err != nil {
+    return err
+  }
+
+  return w.WriteByte(AMF0_OBJECT_END_MARKER)
+}
+
+func writeECMAArray(e *encodeState, keys []string, value func(k string) reflect.Value) error {
+  err := e.WriteByte(byte(AMF0_ECMA_ARRAY_MARKER))
+  if err != nil {
+    return err
+  }
+
+  err = writeU32(e, uint32(len(keys)))
+  if err != nil {
+    return err
+  }
+
+  for _, k := range keys {
+    if k == "" {
+      return errEmptyName
+    }
+    _, err = writeUTF8(e, k)
+    if err != nil {
+      return err
+    }
+
+    e.reflectValue(value(k))
+  }
+  return writeObjectEnd(e)
+}
+
+// writeObjectProperties writes the AMF0 properties in the order of keys
+// followed by the object end marker.
+func writeObjectProperties(e *encodeState, keys []string, values map[string]interface{}) error {
+  for _, k := range keys {
+    if k == "" {
+      return errEmptyName
+    }
+    _, err := writeUTF8(e, k)
+    if err != nil {
+      return err
+    }
+
+    err = e.marshal(values[k])
+    if err != nil {
+      return err
+    }
+  }
+  return writeObjectEnd(e)
+}
+
+func writeStrictArray(e *encodeState, v reflect.Value) error {
   err := e.WriteByte(byte(AMF0_STRICT_ARRAY_MARKER))
   if err != nil {
     return err
   }
   
-  count := uint32(len(arr))
+  count := uint32(v.Len())
   err = binary.Write(e, binary.BigEndian, &count)
   if err != nil {
     return err
   }
   
-  for _, v := range arr {
-    err = e.marshal(v)
-    if err != nil {
-      return err
-    }
+  for i := 0; i < v.Len(); i++ {
+    e.reflectValue(v.Index(i))
   }
   return nil
 }
@@ -280,13 +344,11 @@ func readUTF8Vr(d *decodeState) (string, error) {
     return "", nil
   }
   
-  data := make([]byte, length)
-  _, err = d.Read(data)
+  str, err := d.readString(length)
   if err != nil {
     return "", err
   }
   
-  str := string(data)
   d.addStringRef(str)
   return str, nil
 }
@@ -302,7 +364,7 @@ func readAssocValue(d *decodeState) (k string, v interface{}, err error) {
   }
   
   v, err = d.unmarshal()
-  return
+  return k, v, keyPath(err, k)
 }
 
 //
@@ -322,14 +384,14 @@ func writeU29(w Writer, num uint32) (n int, err error) {
     return w.Write([]byte{byte(num>>7 | 0x80), byte(num & 0x7f)})
   } else if num <= 0x001fffff {
     return w.Write([]byte{byte(num>>14 | 0x80), byte(num>>7 & 0x7f | 0x80), byte(num & 0x7f)})
-  } else if num <= 0x3fffffff {
+  } else if num <= 0x1fffffff {
     return w.Write([]byte{byte(num>>22 | 0x80), byte(num>>15 & 0x7f | 0x80), byte(num>>8 & 0x7f | 0x80), byte(num)})
   }
   return 0, errors.New("out of range")
 }
 
 func writeU29Ref(w Writer, index uint32) error {
-  index = index << 1 & 0x00
+  index = index << 1
   _, err := writeU29(w, index)
   return err
 }
@@ -340,6 +402,14 @@ func writeTraitsRef(w Writer, index uint32) error {
   return err
 }
 
+func writeAMF3Double(w Writer, num float64) error {
+  err := w.WriteByte(AMF3_DOUBLE_MARKER)
+  if err != nil {
+    return err
+  }
+  return binary.Write(w, binary.BigEndian, num)
+}
+
 func writeInteger(w Writer, num uint32) (int, error) {
   err := w.WriteByte(AMF3_INTEGER_MARKER)
   if err != nil {
@@ -349,6 +419,19 @@ func writeInteger(w Writer, num uint32) (int, error) {
   return writeU29(w, num)
 }
 
+func writeAMF3Date(w Writer, t time.Time) error {
+  err := w.WriteByte(AMF3_DATE_MARKER)
+  if err != nil {
+    return err
+  }
+
+  _, err = writeU29(w, 0x01)
+  if err != nil {
+    return err
+  }
+  return binary.Write(w, binary.BigEndian, timeToMs(t))
+}
+
 func writeTrueOrFalse(w Writer, b bool) (n int, err error) {
   if b {
     err = w.WriteByte(AMF3_TRUE_MARKER)
@@ -402,7 +485,174 @@ func writeAMF3EmptyUTF8(w Writer) error {
   return w.WriteByte(AMF3_UTF8_EMPTY)
 }
 
+// writeObjectTraits writes the object marker followed by the traits, as a
+// reference when traits of the same signature were written before.
+func writeObjectTraits(e *encodeState, traits *Traits) error {
+  err := e.WriteByte(byte(AMF3_OBJECT_MARKER))
+  if err != nil {
+    return err
+  }
+
+  if index, ok := e.findTraitsRef(traits); ok {
+    return writeTraitsRef(e, index)
+  }
+  e.addTraitsRef(traits)
+
+  if traits.Externalizable {
+    _, err = writeU29(e, 0x07)
+    if err != nil {
+      return err
+    }
+    _, err = writeUTF8Vr(e, traits.ClassName)
+    return err
+  }
+
+  u29 := uint32(len(traits.Members)) << 4 | 0x03
+  if traits.Dynamic {
+    u29 = u29 | 0x08
+  }
+  _, err = writeU29(e, u29)
+  if err != nil {
+    return err
+  }
+
+  _, err = writeUTF8Vr(e, traits.ClassName)
+  if err != nil {
+    return err
+  }
+
+  for _, name := range traits.Members {
+    _, err = writeUTF8Vr(e, name)
+    if err != nil {
+      return err
+    }
+  }
+  return nil
+}
+
+func writeDenseArray(e *encodeState, v reflect.Value) error {
+  err := e.WriteByte(byte(AMF3_ARRAY_MARKER))
+  if err != nil {
+    return err
+  }
+
+  _, err = writeU29(e, uint32(v.Len()) << 1 | 0x01)
+  if err != nil {
+    return err
+  }
+
+  err = writeAMF3EmptyUTF8(e)
+  if err != nil {
+    return err
+  }
+
+  for i := 0; i < v.Len(); i++ {
+    e.reflectValue(v.Index(i))
+  }
+  return nil
+}
+
+func writeXML(e *encodeState, marker byte, str string, key interface{}) error {
+  ref, err := writeObjectRef(e, marker, key)
+  if ref || err != nil {
+    return err
+  }
+
+  err = e.WriteByte(marker)
+  if err != nil {
+    return err
+  }
+
+  _, err = writeAMF3UTF8(e, str)
+  return err
+}
+
+func readXML(d *decodeState) (string, interface{}, error) {
+  u29, err := readU29(d)
+  if err != nil {
+    return "", nil, err
+  }
+
+  if u29 & 0x01 == 0 {
+    v, err := d.getObjectRef(u29 >> 1)
+    return "", v, err
+  }
+
+  str, err := d.readString(u29 >> 1)
+  return str, nil, err
+}
+
+func writeVector(e *encodeState, vec *Vector, key interface{}) error {
+  marker, ok := vec.marker()
+  if !ok {
+    return errors.New("The values of vector must be []int32, []uint32, []float64 or []interface{}")
+  }
+
+  ref, err := writeObjectRef(e, marker, key)
+  if ref || err != nil {
+    return err
+  }
+
+  err = e.WriteByte(marker)
+  if err != nil {
+    return err
+  }
+
+  length := reflect.ValueOf(vec.Values).Len()
+  _, err = writeU29(e, uint32(length) << 1 | 0x01)
+  if err != nil {
+    return err
+  }
+
+  if vec.Fixed {
+    err = e.WriteByte(0x01)
+  } else {
+    err = e.WriteByte(0x00)
+  }
+  if err != nil {
+    return err
+  }
+
+  values, ok := vec.Values.([]interface{})
+  if !ok {
+    return binary.Write(e, binary.BigEndian, vec.Values)
+  }
+
+  _, err = writeUTF8Vr(e, vec.TypeName)
+  if err != nil {
+    return err
+  }
+
+  for _, v := range values {
+    err = e.marshal(v)
+    if err != nil {
+      return err
+    }
+  }
+  return nil
+}
+
+func writeDictionaryHeader(e *encodeState, length int, weakKeys bool) error {
+  err := e.WriteByte(AMF3_DICTIONARY_MARKER)
+  if err != nil {
+    return err
+  }
+
+  _, err = writeU29(e, uint32(length) << 1 | 0x01)
+  if err != nil {
+    return err
+  }
+
+  if weakKeys {
+    return e.WriteByte(0x01)
+  }
+  return e.WriteByte(0x00)
+}
+
 func writeAssocValue(e *encodeState, k string, v interface{}) (err error) {
+  if k == "" {
+    return errEmptyName
+  }
   _, err = writeUTF8Vr(e, k)
   if err != nil {
     return err